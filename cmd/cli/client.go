@@ -48,18 +48,10 @@ func sendPostRequest(url string, query string) (*QueryResponse, error) {
 	// Set the necessary headers
 	req.Header.Set("Content-Type", "application/json")
 
-	// Initialize a custom HTTP client with a timeout and redirect policy
+	// Initialize a HTTP client with a timeout. Followers forward writes to the
+	// leader, or redirect with a 307 which the client follows with the body.
 	client := &http.Client{
 		Timeout: 30 * time.Second,
-		// Custom redirect policy
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// Reset the body for the redirected request
-			if len(via) > 0 {
-				req.Body = io.NopCloser(bytes.NewReader(body))
-				req.Method = "POST" // Ensure the method stays as POST
-			}
-			return nil
-		},
 	}
 
 	// Send the HTTP request
@@ -1,38 +1,232 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
-	"log"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"path/filepath"
+	"sort"
 
 	_ "github.com/marcboeker/go-duckdb"
 )
 
+// FileName is the name of the database file inside the database directory.
+const FileName = "duckdb.db"
+
+// stateTable holds a single row with the index of the last applied log entry.
+// It lives in the database itself so that it is updated in the same
+// transaction as the statements of the entry.
+const stateTable = "__raft_state"
+
+// metadataTable holds key-value metadata replicated with the log, such as
+// the addresses of the nodes.
+const metadataTable = "__raft_metadata"
+
 type DB struct {
 	dbConn *sql.DB
+
+	// Names of the functions DuckDB does not report as consistent.
+	nondeterministic map[string]bool
 }
 
 func Open(dbDir string) (*DB, error) {
-	log.Printf("Opening database at %s", filepath.Join(dbDir, "duckdb.db"))
-	dbc, err := sql.Open("duckdb", filepath.Join(dbDir, "duckdb.db"))
+	path := filepath.Join(dbDir, FileName)
+	slog.Debug("opening database", "path", path)
+	dbc, err := sql.Open("duckdb", path)
 	if err != nil {
-		log.Printf("Error opening database: %v", err)
+		slog.Error("failed to open database", "path", path, "error", err)
 		return nil, err
 	}
-	log.Printf("Database opened successfully.")
-	return &DB{
+	db := &DB{
 		dbConn: dbc,
-	}, nil
+	}
+	if err := db.initState(); err != nil {
+		slog.Error("failed to initialize database state", "path", path, "error", err)
+		dbc.Close()
+		return nil, err
+	}
+	if err := db.loadFunctions(); err != nil {
+		slog.Error("failed to list functions", "path", path, "error", err)
+		dbc.Close()
+		return nil, err
+	}
+	slog.Info("opened database", "path", path)
+	return db, nil
+}
+
+// initState creates the state and metadata tables if they do not exist yet.
+func (db *DB) initState() error {
+	if _, err := db.dbConn.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (applied_index UBIGINT NOT NULL)", stateTable)); err != nil {
+		return err
+	}
+	if _, err := db.dbConn.Exec(fmt.Sprintf("INSERT INTO %[1]s SELECT 0 WHERE NOT EXISTS (SELECT * FROM %[1]s)", stateTable)); err != nil {
+		return err
+	}
+	_, err := db.dbConn.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key VARCHAR PRIMARY KEY, value VARCHAR NOT NULL)", metadataTable))
+	return err
+}
+
+// loadFunctions lists the functions whose result may differ between calls
+// with the same arguments. These are the functions DuckDB does not report as
+// consistent, which includes every table function, and the macros whose
+// definition calls any of them.
+func (db *DB) loadFunctions() error {
+	rs, err := db.dbConn.Query(`SELECT lower(function_name), function_type IN ('macro', 'table_macro'),
+		stability IS DISTINCT FROM 'CONSISTENT', COALESCE(macro_definition, '') FROM duckdb_functions()`)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	db.nondeterministic = make(map[string]bool)
+	macros := make(map[string][]string)
+	for rs.Next() {
+		var name, definition string
+		var macro, nondeterministic bool
+		if err := rs.Scan(&name, &macro, &nondeterministic, &definition); err != nil {
+			return err
+		}
+		if macro {
+			macros[name] = append(macros[name], definition)
+		} else if nondeterministic {
+			db.nondeterministic[name] = true
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return err
+	}
+
+	// Macros may call other macros: repeat until no more are found.
+	for found := true; found; {
+		found = false
+		for name, definitions := range macros {
+			for _, definition := range definitions {
+				if _, ok := callsNonDeterministic(definition, db.nondeterministic); ok {
+					db.nondeterministic[name] = true
+					delete(macros, name)
+					found = true
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// NonDeterministicFunctions returns the names of the non-deterministic
+// functions, for MakeDeterministic. The list is taken when the database is
+// opened, so it only includes functions of extensions that were loaded by
+// then, and macros created by then.
+func (db *DB) NonDeterministicFunctions() map[string]bool {
+	return db.nondeterministic
+}
+
+// Metadata returns every metadata entry.
+func (db *DB) Metadata() (map[string]string, error) {
+	rs, err := db.dbConn.Query(fmt.Sprintf("SELECT key, value FROM %s", metadataTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	m := make(map[string]string)
+	for rs.Next() {
+		var k, v string
+		if err := rs.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, rs.Err()
+}
+
+// SetMetadata stores value under key, or deletes key if value is empty, in a
+// transaction that also records appliedIndex as the last applied index.
+func (db *DB) SetMetadata(key, value string, appliedIndex uint64) error {
+	tx, err := db.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if value == "" {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE key = ?", metadataTable), key)
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s VALUES (?, ?)", metadataTable), key, value)
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.setAppliedIndex(tx, appliedIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AppliedIndex returns the index of the last log entry applied to the database.
+func (db *DB) AppliedIndex() (uint64, error) {
+	var idx uint64
+	err := db.dbConn.QueryRow(fmt.Sprintf("SELECT applied_index FROM %s", stateTable)).Scan(&idx)
+	return idx, err
+}
+
+// MemoryUsage returns the memory DuckDB uses for the database, in bytes.
+func (db *DB) MemoryUsage() (int64, error) {
+	var n int64
+	err := db.dbConn.QueryRow("SELECT CAST(COALESCE(SUM(memory_usage_bytes), 0) AS BIGINT) FROM duckdb_memory()").Scan(&n)
+	return n, err
+}
+
+// Verify checks that the catalog and the state of the database can be read.
+func (db *DB) Verify() error {
+	var tables int
+	if err := db.dbConn.QueryRow("SELECT count(*) FROM duckdb_tables()").Scan(&tables); err != nil {
+		return err
+	}
+	_, err := db.AppliedIndex()
+	return err
+}
+
+// Checkpoint writes everything in the write-ahead log to the database file.
+func (db *DB) Checkpoint() error {
+	_, err := db.dbConn.Exec("CHECKPOINT")
+	return err
+}
+
+// Export writes the database to dir in Parquet format with EXPORT DATABASE.
+func (db *DB) Export(dir string) error {
+	slog.Info("exporting database", "dir", dir)
+	_, err := db.dbConn.Exec(fmt.Sprintf("EXPORT DATABASE '%s' (FORMAT PARQUET)", dir))
+	return err
+}
+
+// Import loads a database written by Export into this database, including
+// its applied index and metadata.
+func (db *DB) Import(dir string) error {
+	slog.Info("importing database", "dir", dir)
+	for _, table := range []string{stateTable, metadataTable} {
+		if _, err := db.dbConn.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+			return err
+		}
+	}
+	if _, err := db.dbConn.Exec(fmt.Sprintf("IMPORT DATABASE '%s'", dir)); err != nil {
+		return err
+	}
+	// Exports taken before the state table existed don't contain it.
+	return db.initState()
 }
 
 func (db *DB) Close() error {
-	log.Printf("Closing database connection.")
 	err := db.dbConn.Close()
 	if err != nil {
-		log.Printf("Error closing database connection: %v", err)
+		slog.Error("failed to close database", "error", err)
 		return err
 	}
-	log.Printf("Database connection closed successfully.")
+	slog.Debug("closed database")
 	return nil
 }
 
@@ -46,52 +240,261 @@ type QueryResult struct {
 	Values  [][]interface{} `json:"values,omitempty"`
 }
 
-func (db *DB) Execute(query string) (*ExecuteResult, error) {
-	log.Printf("Executing query: %s", query)
-	result := &ExecuteResult{}
-	r, err := db.dbConn.Exec(query, nil)
+// Statement is a single SQL statement together with its bind parameters.
+type Statement struct {
+	SQL    string  `json:"sql"`
+	Params *Params `json:"params,omitempty"`
+}
+
+// Args returns the statement's parameters as driver arguments.
+func (s Statement) Args() ([]interface{}, error) {
+	if s.Params == nil {
+		return nil, nil
+	}
+	return s.Params.Args()
+}
+
+// Params holds the bind parameters of a statement. They are either positional,
+// encoded as a JSON array and bound to ? or $1 placeholders, or named, encoded
+// as a JSON object and bound to $name placeholders.
+//
+// Numbers are decoded without loss of precision, so every replica binds the
+// same value. Binary values are passed as {"blob": "<base64>"}.
+type Params struct {
+	Positional []interface{}
+	Named      map[string]interface{}
+}
+
+func (p Params) MarshalJSON() ([]byte, error) {
+	if p.Named != nil {
+		return json.Marshal(p.Named)
+	}
+	return json.Marshal(p.Positional)
+}
+
+func (p *Params) UnmarshalJSON(b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		p.Positional, p.Named = v, nil
+	case map[string]interface{}:
+		p.Positional, p.Named = nil, v
+	case nil:
+		p.Positional, p.Named = nil, nil
+	default:
+		return fmt.Errorf("params must be an array or an object")
+	}
+	return nil
+}
+
+// Args converts the parameters to arguments for the duckdb driver.
+func (p *Params) Args() ([]interface{}, error) {
+	if p.Named != nil {
+		names := make([]string, 0, len(p.Named))
+		for name := range p.Named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		args := make([]interface{}, len(names))
+		for i, name := range names {
+			v, err := paramValue(p.Named[name])
+			if err != nil {
+				return nil, fmt.Errorf("param %q: %v", name, err)
+			}
+			args[i] = sql.Named(name, v)
+		}
+		return args, nil
+	}
+
+	args := make([]interface{}, len(p.Positional))
+	for i, pv := range p.Positional {
+		v, err := paramValue(pv)
+		if err != nil {
+			return nil, fmt.Errorf("param %d: %v", i+1, err)
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+// paramValue converts a decoded JSON value to a value the driver can bind.
+func paramValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, string, int64, float64, []byte:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", v)
+		}
+		return f, nil
+	case map[string]interface{}:
+		s, ok := v["blob"].(string)
+		if !ok || len(v) != 1 {
+			return nil, fmt.Errorf("unsupported object value, expected {\"blob\": \"<base64>\"}")
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob: %v", err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported value of type %T", v)
+	}
+}
+
+// ExecuteBatch executes the statements in a single transaction, which also
+// records appliedIndex as the index of the last applied log entry. Either
+// every statement is committed or, if any of them fails, none are; the index
+// is recorded either way, even if ctx is cancelled.
+func (db *DB) ExecuteBatch(ctx context.Context, stmts []Statement, appliedIndex uint64) ([]*ExecuteResult, error) {
+	slog.Debug("executing batch", "statements", len(stmts), "index", appliedIndex)
+	tx, err := db.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("failed to start transaction", "error", err)
+		return nil, err
+	}
+
+	results := make([]*ExecuteResult, 0, len(stmts))
+	for i, stmt := range stmts {
+		logStatement("executing statement", stmt.SQL, "index", appliedIndex)
+		done := running.start(RunningQuery{SQL: stmt.SQL, Write: true, Index: appliedIndex}, nil)
+		result, err := execStatement(ctx, tx, stmt)
+		done()
+		if err != nil {
+			slog.Debug("statement failed", "statement", i+1, "index", appliedIndex, "error", err)
+			if rbErr := tx.Rollback(); rbErr != nil {
+				slog.Error("failed to roll back transaction", "error", rbErr)
+			}
+			if err := db.setAppliedIndex(db.dbConn, appliedIndex); err != nil {
+				slog.Error("failed to record applied index", "index", appliedIndex, "error", err)
+			}
+			if len(stmts) > 1 {
+				err = fmt.Errorf("statement %d: %v", i+1, err)
+			}
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if err := db.setAppliedIndex(tx, appliedIndex); err != nil {
+		slog.Error("failed to record applied index", "index", appliedIndex, "error", err)
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit transaction", "index", appliedIndex, "error", err)
+		return nil, err
+	}
+	slog.Debug("batch executed", "statements", len(stmts), "index", appliedIndex)
+	return results, nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (db *DB) setAppliedIndex(e execer, idx uint64) error {
+	_, err := e.Exec(fmt.Sprintf("UPDATE %s SET applied_index = ?", stateTable), idx)
+	return err
+}
+
+func execStatement(ctx context.Context, tx *sql.Tx, stmt Statement) (*ExecuteResult, error) {
+	args, err := stmt.Args()
+	if err != nil {
+		return nil, err
+	}
+	r, err := tx.ExecContext(ctx, stmt.SQL, args...)
 	if err != nil {
-		log.Printf("Error executing query: %v", err)
 		return nil, err
 	}
 	ra, err := r.RowsAffected()
 	if err != nil {
-		log.Printf("Error fetching rows affected: %v", err)
 		return nil, err
 	}
-	result.RowsAffected = ra
-	log.Printf("Query executed successfully. Rows affected: %d", ra)
-	return result, nil
+	return &ExecuteResult{RowsAffected: ra}, nil
 }
 
-func (db *DB) Query(query string) (*QueryResult, error) {
-	log.Printf("Executing query: %s", query)
+// RowWriter receives the result of a query as its rows are read.
+type RowWriter interface {
+	// WriteColumns is called once, before any row, with the names and
+	// database types of the columns.
+	WriteColumns(columns, types []string) error
+	// WriteRow is called for every row. Returning an error stops the query,
+	// which then fails with that error.
+	WriteRow(values []interface{}) error
+}
+
+func (r *QueryResult) WriteColumns(columns, types []string) error {
+	r.Columns, r.Types = columns, types
+	return nil
+}
+
+func (r *QueryResult) WriteRow(values []interface{}) error {
+	r.Values = append(r.Values, values)
+	return nil
+}
+
+// Query runs the query and returns all of its rows. Cancelling ctx or
+// killing the query interrupts it.
+func (db *DB) Query(ctx context.Context, query string, args ...interface{}) (*QueryResult, error) {
 	rows := &QueryResult{}
-	rs, err := db.dbConn.Query(query, nil)
-	if err != nil {
-		log.Printf("Error executing query: %v", err)
+	if err := db.QueryRows(ctx, rows, query, args...); err != nil {
 		return nil, err
 	}
+	return rows, nil
+}
+
+// QueryRows runs the query and hands its rows to w as they are read, without
+// holding them in memory. Cancelling ctx or killing the query interrupts it.
+func (db *DB) QueryRows(ctx context.Context, w RowWriter, query string, args ...interface{}) error {
+	logStatement("executing query", query)
+	ctx, done := running.startQuery(ctx, query)
+	defer done()
+	if err := db.query(ctx, w, query, args...); err != nil {
+		return killed(ctx, err)
+	}
+	return nil
+}
+
+func (db *DB) query(ctx context.Context, w RowWriter, query string, args ...interface{}) error {
+	rs, err := db.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		slog.Debug("query failed", "error", err)
+		return err
+	}
 	defer rs.Close()
 
 	columns, err := rs.Columns()
 	if err != nil {
-		log.Printf("Error fetching columns: %v", err)
-		return nil, err
+		slog.Debug("failed to fetch columns", "error", err)
+		return err
 	}
-	rows.Columns = columns
 	columnTypes, err := rs.ColumnTypes()
 	if err != nil {
-		log.Printf("Error fetching column types: %v", err)
-		return nil, err
+		slog.Debug("failed to fetch column types", "error", err)
+		return err
 	}
 
 	typeNames := make([]string, len(columnTypes))
 	for i, colType := range columnTypes {
 		typeNames[i] = colType.DatabaseTypeName()
 	}
-	rows.Types = typeNames
+	if err := w.WriteColumns(columns, typeNames); err != nil {
+		return err
+	}
 
+	n := 0
 	for rs.Next() {
 		dest := make([]interface{}, len(columns))
 		pointers := make([]interface{}, len(columns))
@@ -100,8 +503,8 @@ func (db *DB) Query(query string) (*QueryResult, error) {
 		}
 
 		if err := rs.Scan(pointers...); err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			return nil, err
+			slog.Debug("failed to scan row", "error", err)
+			return err
 		}
 
 		for i, v := range dest {
@@ -109,9 +512,18 @@ func (db *DB) Query(query string) (*QueryResult, error) {
 				dest[i] = string(b)
 			}
 		}
-		rows.Values = append(rows.Values, dest)
+		if err := w.WriteRow(dest); err != nil {
+			slog.Debug("stopped reading rows", "rows", n, "error", err)
+			return err
+		}
+		n++
 	}
 
-	log.Printf("Query executed successfully with %d rows.", len(rows.Values))
-	return rows, err
+	if err := rs.Err(); err != nil {
+		slog.Debug("failed to read rows", "error", err)
+		return err
+	}
+
+	slog.Debug("query executed", "rows", n)
+	return nil
 }
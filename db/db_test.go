@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		want    []interface{}
+		jsonErr bool // Whether the params are rejected when decoded.
+		argsErr bool // Whether Args rejects them.
+	}{
+		{"positional", `[1, "a", true, null, 1.5]`, []interface{}{int64(1), "a", true, nil, 1.5}, false, false},
+		{"max int64", `[9223372036854775807, -9223372036854775808]`, []interface{}{int64(9223372036854775807), int64(-9223372036854775808)}, false, false},
+		{"large integer", `[9223372036854775808]`, []interface{}{9223372036854775808.0}, false, false},
+		{"exponent", `[1e3]`, []interface{}{1000.0}, false, false},
+		{"blob", `[{"blob": "aGk="}]`, []interface{}{[]byte("hi")}, false, false},
+		{"named", `{"b": 2, "a": "x"}`, []interface{}{sql.Named("a", "x"), sql.Named("b", int64(2))}, false, false},
+		{"null", `null`, []interface{}{}, false, false},
+		{"empty", `[]`, []interface{}{}, false, false},
+
+		{"invalid blob", `[{"blob": "not base64!"}]`, nil, false, true},
+		{"blob not a string", `[{"blob": 1}]`, nil, false, true},
+		{"other object", `[{"value": 1}]`, nil, false, true},
+		{"blob with other keys", `[{"blob": "aGk=", "x": 1}]`, nil, false, true},
+		{"array value", `[[1, 2]]`, nil, false, true},
+		{"invalid named value", `{"a": [1]}`, nil, false, true},
+
+		{"string", `"a"`, nil, true, false},
+		{"number", `1`, nil, true, false},
+		{"invalid JSON", `[1,`, nil, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Params
+			err := json.Unmarshal([]byte(tt.params), &p)
+			if tt.jsonErr {
+				if err == nil {
+					t.Fatalf("Unmarshal(%s) succeeded, want an error", tt.params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unmarshal(%s) error = %v", tt.params, err)
+			}
+
+			args, err := p.Args()
+			if tt.argsErr {
+				if err == nil {
+					t.Fatalf("Args() of %s = %v, want an error", tt.params, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Args() of %s error = %v", tt.params, err)
+			}
+			if len(args) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("Args() of %s = %#v, want %#v", tt.params, args, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamsMarshal(t *testing.T) {
+	for _, params := range []string{`[1,"a",null]`, `{"a":12345678901234567890}`} {
+		var p Params
+		if err := json.Unmarshal([]byte(params), &p); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", params, err)
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Marshal(%s) error = %v", params, err)
+		}
+		if string(b) != params {
+			t.Errorf("Marshal(Unmarshal(%s)) = %s", params, b)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNonDeterministic is returned for statements that would give different
+// results on different replicas and cannot be rewritten so they don't.
+var ErrNonDeterministic = errors.New("statement is not deterministic")
+
+// Functions whose value is fixed for the duration of a transaction. Replacing
+// them with a literal computed once is exact.
+var stableFunctions = map[string]func(now time.Time) string{
+	"now":                   timestamptzLiteral,
+	"get_current_timestamp": timestamptzLiteral,
+	"transaction_timestamp": timestamptzLiteral,
+	"current_timestamp":     timestamptzLiteral,
+	"today":                 dateLiteral,
+	"current_date":          dateLiteral,
+	"get_current_time":      timetzLiteral,
+	"current_time":          timetzLiteral,
+	"localtimestamp":        timestampLiteral,
+	"localtime":             timeLiteral,
+}
+
+// Functions that are also valid without parentheses.
+var keywordFunctions = map[string]bool{
+	"current_timestamp": true,
+	"current_date":      true,
+	"current_time":      true,
+	"localtimestamp":    true,
+	"localtime":         true,
+}
+
+// Functions that return a new value on every call, i.e. once per row.
+var volatileFunctions = map[string]func() (string, error){
+	"random":          randomLiteral,
+	"gen_random_uuid": uuidLiteral,
+	"uuid":            uuidLiteral,
+}
+
+// Functions DuckDB does not report as consistent, but which return the same
+// value on every replica: they only depend on the catalog and on sequences,
+// which are the same on every node after applying the same log, or, for the
+// table functions, on their arguments.
+var replicatedFunctions = map[string]bool{
+	"nextval":          true,
+	"error":            true,
+	"current_database": true,
+	"current_schema":   true,
+	"current_schemas":  true,
+	"in_search_path":   true,
+
+	"range":           true,
+	"generate_series": true,
+	"unnest":          true,
+	"repeat":          true,
+	"repeat_row":      true,
+}
+
+// Functions that are rejected even if DuckDB does not list them, because
+// they depend on the session or change its state.
+var rejectedFunctions = map[string]bool{
+	"setseed":       true,
+	"currval":       true,
+	"txid_current":  true,
+	"current_query": true,
+}
+
+// isNonDeterministic reports whether the function name may return different
+// values on different replicas. nondeterministic is as for MakeDeterministic.
+func isNonDeterministic(name string, nondeterministic map[string]bool) bool {
+	if replicatedFunctions[name] {
+		return false
+	}
+	_, stable := stableFunctions[name]
+	_, volatile := volatileFunctions[name]
+	return stable || volatile || rejectedFunctions[name] || nondeterministic[name]
+}
+
+// isCall reports whether the word tokens[i] calls a function, rather than
+// naming a column, table or type that happens to share its name.
+func isCall(tokens []token, i int) bool {
+	return (i+1 < len(tokens) && tokens[i+1].isPunct("(")) || keywordFunctions[strings.ToLower(tokens[i].text)]
+}
+
+// callsNonDeterministic returns the first non-deterministic function the SQL
+// expression or statement query calls, if any.
+func callsNonDeterministic(query string, nondeterministic map[string]bool) (string, bool) {
+	tokens := lex(query)
+	for i, t := range tokens {
+		name := strings.ToLower(t.text)
+		if t.kind == tokenWord && isNonDeterministic(name, nondeterministic) && isCall(tokens, i) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// MakeDeterministic replaces calls to non-deterministic functions such as
+// now() and random() in stmt with literal values, so that applying the
+// statement on every replica has the same effect. now is the transaction time
+// used for the time functions, and nondeterministic holds the names of the
+// functions that are not consistent, see DB.NonDeterministicFunctions.
+//
+// Time functions are always replaced, since DuckDB evaluates them once per
+// transaction anyway. Per-row functions such as random() are only replaced in
+// INSERT ... VALUES, where each call is evaluated exactly once; anywhere else
+// the statement is rejected with ErrNonDeterministic, as are column defaults
+// using any of these functions. Calls to any other non-deterministic
+// function are rejected too, and so are views and macros calling any of them,
+// since writes reading them would evaluate them on each replica. Each
+// statement of a multi-statement stmt is checked on its own.
+func MakeDeterministic(stmt Statement, now time.Time, nondeterministic map[string]bool) (Statement, error) {
+	r := rewriter{query: stmt.SQL, now: now, nondeterministic: nondeterministic}
+	for _, tokens := range splitStatements(lex(stmt.SQL)) {
+		if err := r.rewrite(tokens); err != nil {
+			return stmt, err
+		}
+	}
+	if r.last == 0 {
+		return stmt, nil
+	}
+	r.b.WriteString(stmt.SQL[r.last:])
+
+	return Statement{SQL: r.b.String(), Params: stmt.Params}, nil
+}
+
+// splitStatements splits the tokens of a SQL string at the semicolons
+// between its statements.
+func splitStatements(tokens []token) [][]token {
+	var stmts [][]token
+	start := 0
+	for i, t := range tokens {
+		if t.isPunct(";") {
+			stmts = append(stmts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(stmts, tokens[start:])
+}
+
+// rewriter builds the deterministic version of a SQL string, one statement
+// at a time.
+type rewriter struct {
+	query            string
+	now              time.Time
+	nondeterministic map[string]bool
+
+	b    strings.Builder
+	last int // Offset in query up to which b holds the rewritten SQL.
+}
+
+// rewrite replaces the non-deterministic calls of the statement made of
+// tokens, or returns ErrNonDeterministic if it cannot.
+func (r *rewriter) rewrite(tokens []token) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// The bodies of views and macros are evaluated whenever they are read,
+	// on each node separately, so they are kept as they are and may not call
+	// any non-deterministic function.
+	definition := false
+	if tokens[0].isWord("create") {
+		for _, t := range tokens[1:] {
+			if t.isWord("view") || t.isWord("macro") || t.isWord("function") {
+				definition = true
+				break
+			}
+			if t.isWord("table") || t.isWord("as") || t.kind != tokenWord {
+				break
+			}
+		}
+	}
+
+	insertValues := tokens[0].isWord("insert")
+	for _, t := range tokens {
+		if t.isWord("select") {
+			insertValues = false
+			break
+		}
+	}
+
+	ddl := tokens[0].isWord("create") || tokens[0].isWord("alter")
+	seenDefault := false
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if ddl && t.isWord("default") {
+			seenDefault = true
+		}
+		if t.kind != tokenWord {
+			continue
+		}
+		name := strings.ToLower(t.text)
+		if !isNonDeterministic(name, r.nondeterministic) || !isCall(tokens, i) {
+			continue
+		}
+		_, stable := stableFunctions[name]
+		_, volatile := volatileFunctions[name]
+
+		call := i+1 < len(tokens) && tokens[i+1].isPunct("(")
+		if i > 0 && tokens[i-1].isPunct(".") {
+			// A qualified column, or a qualified or method call.
+			if call {
+				return fmt.Errorf("%w: %s() cannot be replicated", ErrNonDeterministic, name)
+			}
+			continue
+		}
+		if definition {
+			ref := t.text
+			if call {
+				ref = name + "()"
+			}
+			return fmt.Errorf("%w: %s in a view or macro would be evaluated separately on each node", ErrNonDeterministic, ref)
+		}
+
+		// Only calls without arguments are rewritten.
+		end := i
+		if call {
+			if (!stable && !volatile) || i+2 >= len(tokens) || !tokens[i+2].isPunct(")") {
+				return fmt.Errorf("%w: %s() cannot be replicated", ErrNonDeterministic, name)
+			}
+			end = i + 2
+		}
+		if seenDefault {
+			return fmt.Errorf("%w: column default %s would be evaluated separately on each node", ErrNonDeterministic, t.text)
+		}
+
+		var literal string
+		if stable {
+			literal = stableFunctions[name](r.now)
+		} else {
+			if !insertValues {
+				return fmt.Errorf("%w: %s() is only supported in INSERT ... VALUES", ErrNonDeterministic, name)
+			}
+			var err error
+			if literal, err = volatileFunctions[name](); err != nil {
+				return err
+			}
+		}
+
+		r.b.WriteString(r.query[r.last:t.start])
+		r.b.WriteString(literal)
+		r.last = tokens[end].end
+		i = end
+	}
+	return nil
+}
+
+func timestamptzLiteral(now time.Time) string {
+	return "CAST('" + now.UTC().Format("2006-01-02 15:04:05.999999") + "+00' AS TIMESTAMPTZ)"
+}
+
+func timestampLiteral(now time.Time) string {
+	return "CAST('" + now.Local().Format("2006-01-02 15:04:05.999999") + "' AS TIMESTAMP)"
+}
+
+func dateLiteral(now time.Time) string {
+	return "CAST('" + now.Local().Format("2006-01-02") + "' AS DATE)"
+}
+
+func timetzLiteral(now time.Time) string {
+	return "CAST('" + now.Local().Format("15:04:05.999999-07:00") + "' AS TIMETZ)"
+}
+
+func timeLiteral(now time.Time) string {
+	return "CAST('" + now.Local().Format("15:04:05.999999") + "' AS TIME)"
+}
+
+func randomLiteral() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	if err != nil {
+		return "", err
+	}
+	f := float64(n.Int64()) / math.Exp2(53)
+	return "CAST(" + strconv.FormatFloat(f, 'g', -1, 64) + " AS DOUBLE)", nil
+}
+
+func uuidLiteral() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("CAST('%x-%x-%x-%x-%x' AS UUID)", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
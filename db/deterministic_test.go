@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// Some of the functions of DuckDB 1.1.3 that DB.NonDeterministicFunctions
+// lists.
+var testNondeterministic = map[string]bool{
+	"current_database": true, "current_date": true, "current_schema": true,
+	"current_schemas": true, "get_current_time": true, "get_current_timestamp": true,
+	"in_search_path": true, "now": true, "today": true, "transaction_timestamp": true,
+	"txid_current": true, "current_query": true, "currval": true, "error": true,
+	"gen_random_uuid": true, "nextval": true, "random": true, "setseed": true,
+	"stats": true, "uuid": true, "glob": true, "duckdb_memory": true, "range": true,
+	"pg_postmaster_start_time": true,
+}
+
+var (
+	randomLiteralRe = regexp.MustCompile(`CAST\([0-9.e-]+ AS DOUBLE\)`)
+	uuidLiteralRe   = regexp.MustCompile(`CAST\('[0-9a-f-]{36}' AS UUID\)`)
+)
+
+func TestMakeDeterministic(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+	ts := "CAST('2024-05-06 07:08:09.123456+00' AS TIMESTAMPTZ)"
+
+	tests := []struct {
+		name string
+		sql  string
+		want string // With random and UUID literals replaced by <random> and <uuid>.
+		err  bool
+	}{
+		{"no functions", "INSERT INTO t VALUES (1, 'a')", "INSERT INTO t VALUES (1, 'a')", false},
+		{"now", "INSERT INTO t VALUES (now())", "INSERT INTO t VALUES (" + ts + ")", false},
+		{"case insensitive", "UPDATE t SET ts = NOW ( )", "UPDATE t SET ts = " + ts, false},
+		{"keyword", "UPDATE t SET ts = current_timestamp", "UPDATE t SET ts = " + ts, false},
+		{"insert select", "INSERT INTO t SELECT now() FROM s", "INSERT INTO t SELECT " + ts + " FROM s", false},
+
+		{"line comment", "INSERT INTO t VALUES (1) -- now(), random()", "INSERT INTO t VALUES (1) -- now(), random()", false},
+		{"block comment", "INSERT /* random() */ INTO t VALUES (1)", "INSERT /* random() */ INTO t VALUES (1)", false},
+		{"string", "INSERT INTO t VALUES ('now()', 'it''s random()')", "INSERT INTO t VALUES ('now()', 'it''s random()')", false},
+		{"escape string", `INSERT INTO t VALUES (E'\' random()')`, `INSERT INTO t VALUES (E'\' random()')`, false},
+		{"dollar string", "INSERT INTO t VALUES ($$random()$$)", "INSERT INTO t VALUES ($$random()$$)", false},
+		{"quoted identifier", `SELECT "now"() FROM t`, `SELECT "now"() FROM t`, false},
+		{"column", "INSERT INTO t (now, uuid) VALUES (1, 2)", "INSERT INTO t (now, uuid) VALUES (1, 2)", false},
+		{"qualified column", "UPDATE t SET a = t.now", "UPDATE t SET a = t.now", false},
+		{"type", "CREATE TABLE t (id UUID)", "CREATE TABLE t (id UUID)", false},
+
+		{"random in values", "INSERT INTO t VALUES (random(), uuid())", "INSERT INTO t VALUES (<random>, <uuid>)", false},
+		{"random in insert select", "INSERT INTO t SELECT random() FROM s", "", true},
+		{"random in update", "UPDATE t SET a = random()", "", true},
+
+		{"default now", "CREATE TABLE t (ts TIMESTAMP DEFAULT now())", "", true},
+		{"default keyword", "ALTER TABLE t ADD COLUMN d DATE DEFAULT current_date", "", true},
+		{"default nextval", "CREATE TABLE t (id INTEGER DEFAULT nextval('seq'))", "CREATE TABLE t (id INTEGER DEFAULT nextval('seq'))", false},
+		{"view", "CREATE VIEW v AS SELECT a + 1 AS b FROM t", "CREATE VIEW v AS SELECT a + 1 AS b FROM t", false},
+		{"view random", "CREATE VIEW v AS SELECT random() r", "", true},
+		{"view now", "CREATE OR REPLACE VIEW v AS SELECT * FROM t WHERE ts > now()", "", true},
+		{"view table function", "CREATE VIEW v AS SELECT * FROM glob('/tmp/*')", "", true},
+		{"macro", "CREATE MACRO add(a, b) AS a + b", "CREATE MACRO add(a, b) AS a + b", false},
+		{"macro random", "CREATE MACRO rnd() AS random()", "", true},
+		{"table macro", "CREATE MACRO m() AS TABLE SELECT current_date", "", true},
+
+		{"nextval", "INSERT INTO t VALUES (nextval('seq'))", "INSERT INTO t VALUES (nextval('seq'))", false},
+		{"current_schema", "INSERT INTO t VALUES (current_schema())", "INSERT INTO t VALUES (current_schema())", false},
+		{"setseed", "SELECT setseed(0.5)", "", true},
+		{"txid_current", "INSERT INTO t VALUES (txid_current())", "", true},
+		{"current_query", "INSERT INTO t VALUES (current_query())", "", true},
+		{"currval", "INSERT INTO t VALUES (currval('seq'))", "", true},
+		{"stats", "INSERT INTO t SELECT stats(a) FROM s", "", true},
+		{"qualified call", "INSERT INTO t VALUES (main.txid_current())", "", true},
+		{"arguments", "INSERT INTO t VALUES (now(1))", "", true},
+
+		{"table function", "INSERT INTO t SELECT * FROM duckdb_memory()", "", true},
+		{"glob", "INSERT INTO t SELECT file FROM glob('/tmp/*')", "", true},
+		{"range", "INSERT INTO t SELECT * FROM range(10)", "INSERT INTO t SELECT * FROM range(10)", false},
+		{"macro call", "INSERT INTO t VALUES (pg_postmaster_start_time())", "", true},
+
+		{"statements", "INSERT INTO t VALUES (now()); UPDATE t SET a = 1", "INSERT INTO t VALUES (" + ts + "); UPDATE t SET a = 1", false},
+		{"random in second statement", "INSERT INTO t VALUES (1); UPDATE t SET r = random()", "", true},
+		{"random in each statement", "INSERT INTO t VALUES (random()); INSERT INTO t VALUES (uuid());", "INSERT INTO t VALUES (<random>); INSERT INTO t VALUES (<uuid>);", false},
+		{"view after insert", "INSERT INTO t VALUES (1); CREATE VIEW v AS SELECT random()", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MakeDeterministic(Statement{SQL: tt.sql}, now, testNondeterministic)
+			if tt.err {
+				if !errors.Is(err, ErrNonDeterministic) {
+					t.Fatalf("MakeDeterministic(%q) error = %v, want ErrNonDeterministic", tt.sql, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MakeDeterministic(%q) error = %v", tt.sql, err)
+			}
+			sql := randomLiteralRe.ReplaceAllString(got.SQL, "<random>")
+			sql = uuidLiteralRe.ReplaceAllString(sql, "<uuid>")
+			if sql != tt.want {
+				t.Errorf("MakeDeterministic(%q) = %q, want %q", tt.sql, sql, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonDeterministicFunctions(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	nondeterministic := db.NonDeterministicFunctions()
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"random", true},
+		{"now", true},
+		{"glob", true},                     // A table function.
+		{"duckdb_memory", true},            // A table function.
+		{"format_type", true},              // A macro reading duckdb_types().
+		{"current_query", true},            // A macro calling main.current_query().
+		{"pg_postmaster_start_time", true}, // A macro for current_timestamp.
+		{"range", false},                   // An allowed table function.
+		{"nullif", false},                  // A macro.
+		{"list_sum", false},                // A macro.
+		{"abs", false},
+	}
+	for _, tt := range tests {
+		if got := isNonDeterministic(tt.name, nondeterministic); got != tt.want {
+			t.Errorf("isNonDeterministic(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import "strings"
+
+type tokenKind int
+
+const (
+	tokenWord   tokenKind = iota // keyword or unquoted identifier
+	tokenIdent                   // "quoted identifier"
+	tokenString                  // 'string', E'string' or $tag$string$tag$
+	tokenNumber                  // numeric literal
+	tokenParam                   // ?, $1 or $name
+	tokenPunct                   // any other single character
+)
+
+// token is a lexical token of a SQL statement. Whitespace and comments are
+// not returned as tokens.
+type token struct {
+	kind  tokenKind
+	start int // offset of the first byte in the statement
+	end   int // offset one past the last byte
+	text  string
+}
+
+// lex splits a SQL statement into tokens. It only knows as much of the DuckDB
+// grammar as needed to tell literals, identifiers and comments apart, and
+// never fails: unterminated literals run to the end of the input.
+func lex(query string) []token {
+	var tokens []token
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		start := i
+		switch {
+		case isSpace(c):
+			i++
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			continue
+		case c == '\'':
+			i = scanQuoted(query, i, '\'', false)
+			tokens = append(tokens, token{kind: tokenString, start: start, end: i})
+		case (c == 'e' || c == 'E') && i+1 < len(query) && query[i+1] == '\'':
+			i = scanQuoted(query, i+1, '\'', true)
+			tokens = append(tokens, token{kind: tokenString, start: start, end: i})
+		case c == '"':
+			i = scanQuoted(query, i, '"', false)
+			tokens = append(tokens, token{kind: tokenIdent, start: start, end: i})
+		case c == '$':
+			j := i + 1
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			tag := query[i:j]
+			if j < len(query) && query[j] == '$' && (len(tag) == 1 || !isDigit(tag[1])) {
+				// Dollar-quoted string: $tag$ ... $tag$
+				delim := query[i : j+1]
+				end := strings.Index(query[j+1:], delim)
+				if end < 0 {
+					i = len(query)
+				} else {
+					i = j + 1 + end + len(delim)
+				}
+				tokens = append(tokens, token{kind: tokenString, start: start, end: i})
+			} else {
+				i = j
+				tokens = append(tokens, token{kind: tokenParam, start: start, end: i})
+			}
+		case c == '?':
+			i++
+			tokens = append(tokens, token{kind: tokenParam, start: start, end: i})
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			for i < len(query) && (isWordChar(query[i]) || query[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, start: start, end: i})
+		case isWordChar(c) || c >= 0x80:
+			for i < len(query) && (isWordChar(query[i]) || query[i] >= 0x80) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, start: start, end: i})
+		default:
+			i++
+			tokens = append(tokens, token{kind: tokenPunct, start: start, end: i})
+		}
+		tokens[len(tokens)-1].text = query[start:i]
+	}
+	return tokens
+}
+
+// scanQuoted returns the offset just past the literal quoted by q that starts
+// at i. A doubled quote is an escaped quote; with backslash set, so is \q.
+func scanQuoted(query string, i int, q byte, backslash bool) int {
+	i++
+	for i < len(query) {
+		switch query[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case q:
+			if i+1 < len(query) && query[i+1] == q {
+				i++
+			} else {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(query)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isWord reports whether t is the unquoted word w, ignoring case.
+func (t token) isWord(w string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, w)
+}
+
+func (t token) isPunct(p string) bool {
+	return t.kind == tokenPunct && t.text == p
+}
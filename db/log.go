@@ -0,0 +1,36 @@
+package db
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// LogSQL enables logging of every statement the database executes. Literals
+// are redacted, and parameter values are never logged.
+var LogSQL bool
+
+// logStatement logs query at info level if LogSQL is set.
+func logStatement(msg, query string, args ...any) {
+	if LogSQL {
+		slog.Info(msg, append([]any{"sql", Redact(query)}, args...)...)
+	}
+}
+
+// Redact replaces the string and numeric literals of query with ?, so that it
+// can be logged without leaking the values it contains. Comments, which may
+// contain values too, are dropped.
+func Redact(query string) string {
+	var b strings.Builder
+	for i, t := range lex(query) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		switch t.kind {
+		case tokenString, tokenNumber:
+			b.WriteByte('?')
+		default:
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
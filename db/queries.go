@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueryNotFound is returned when killing a query that is not running.
+	ErrQueryNotFound = errors.New("query not found")
+
+	// ErrNotKillable is returned when killing a write, which every node
+	// must apply the same way.
+	ErrNotKillable = errors.New("writes applied through Raft cannot be killed")
+
+	// ErrQueryKilled is returned by a query killed with Kill.
+	ErrQueryKilled = errors.New("query killed")
+)
+
+// running tracks the statements executing in the process. It outlives the
+// databases, which are replaced when a snapshot is restored, so IDs are never
+// reused.
+var running queries
+
+// QueryInfo describes the origin of a query, for RunningQuery.
+type QueryInfo struct {
+	Client string
+	Level  string
+}
+
+type queryInfoKey struct{}
+
+// WithQueryInfo returns a copy of ctx that carries info to the queries
+// run with it.
+func WithQueryInfo(ctx context.Context, info QueryInfo) context.Context {
+	return context.WithValue(ctx, queryInfoKey{}, info)
+}
+
+// RunningQuery is a statement executing on the database. Writes are applied
+// through Raft and carry the index of their log entry instead of a client.
+type RunningQuery struct {
+	ID       uint64    `json:"id"`
+	SQL      string    `json:"sql"` // Redacted, see Redact.
+	Client   string    `json:"client,omitempty"`
+	Level    string    `json:"level,omitempty"`
+	Write    bool      `json:"write"`
+	Index    uint64    `json:"index,omitempty"`
+	Killable bool      `json:"killable"`
+	Started  time.Time `json:"started"`
+	Elapsed  float64   `json:"elapsed"` // Milliseconds.
+}
+
+type runningQuery struct {
+	RunningQuery
+	cancel context.CancelCauseFunc // Nil for writes.
+}
+
+// queries tracks running statements.
+type queries struct {
+	mu      sync.Mutex
+	nextID  uint64
+	running map[uint64]*runningQuery
+}
+
+// start registers a statement and returns a function that unregisters it.
+func (q *queries) start(rq RunningQuery, cancel context.CancelCauseFunc) func() {
+	rq.SQL = Redact(rq.SQL)
+	rq.Killable = cancel != nil
+	rq.Started = time.Now()
+
+	q.mu.Lock()
+	q.nextID++
+	rq.ID = q.nextID
+	if q.running == nil {
+		q.running = make(map[uint64]*runningQuery)
+	}
+	q.running[rq.ID] = &runningQuery{RunningQuery: rq, cancel: cancel}
+	q.mu.Unlock()
+
+	return func() {
+		q.mu.Lock()
+		delete(q.running, rq.ID)
+		q.mu.Unlock()
+	}
+}
+
+// startQuery registers a read and returns its context, which Kill cancels,
+// and a function that unregisters it.
+func (q *queries) startQuery(ctx context.Context, query string) (context.Context, func()) {
+	info, _ := ctx.Value(queryInfoKey{}).(QueryInfo)
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := q.start(RunningQuery{SQL: query, Client: info.Client, Level: info.Level}, cancel)
+	return ctx, func() {
+		done()
+		cancel(nil)
+	}
+}
+
+// Running returns the statements executing on this node, oldest first.
+func Running() []RunningQuery {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+
+	now := time.Now()
+	list := make([]RunningQuery, 0, len(running.running))
+	for _, rq := range running.running {
+		q := rq.RunningQuery
+		q.Elapsed = float64(now.Sub(q.Started).Milliseconds())
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Kill interrupts the running query with the given ID, which then fails
+// with ErrQueryKilled.
+func Kill(id uint64) error {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+
+	rq, ok := running.running[id]
+	if !ok {
+		return ErrQueryNotFound
+	}
+	if rq.cancel == nil {
+		return ErrNotKillable
+	}
+	rq.cancel(ErrQueryKilled)
+	return nil
+}
+
+// killed returns ErrQueryKilled in place of err if the query of ctx was
+// killed.
+func killed(ctx context.Context, err error) error {
+	if context.Cause(ctx) == ErrQueryKilled {
+		return ErrQueryKilled
+	}
+	return err
+}
@@ -1,28 +1,93 @@
 package http
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/NamanMahor/duckdb-service/db"
+	"github.com/NamanMahor/duckdb-service/metrics"
 	"github.com/NamanMahor/duckdb-service/store"
 )
 
+const (
+	// How long a read with min_index waits for the node to catch up.
+	minIndexTimeout = 5 * time.Second
+
+	// How long a request proxied to the leader may take, if it has no
+	// timeout of its own.
+	forwardTimeout = 30 * time.Second
+
+	// Defaults of Service.DefaultTimeout and Service.MaxTimeout.
+	defaultTimeout    = time.Minute
+	defaultMaxTimeout = 10 * time.Minute
+
+	// Seconds a client should wait before retrying when there is no leader.
+	retryAfter = "1"
+
+	// How often a request waiting for a leader retries a leader that is down.
+	leaderRetryInterval = 100 * time.Millisecond
+
+	// Default of Service.ReadyMaxLag.
+	defaultReadyMaxLag = 100
+
+	// How long /cluster/nodes waits for each node to report its state.
+	nodeStateTimeout = 2 * time.Second
+
+	// How long a leadership transfer waits to report the new leader.
+	leaderTransferWait = 5 * time.Second
+)
+
+// ClientRequest is the body of /db/execute and /db/query. Params are either
+// positional (a JSON array bound to ? or $1) or named (a JSON object bound to
+// $name). Statements is only accepted by /db/execute and runs the statements
+// in a single transaction.
 type ClientRequest struct {
-	SQL string `json:"sql"`
+	SQL        string         `json:"sql"`
+	Params     *db.Params     `json:"params,omitempty"`
+	Statements []db.Statement `json:"statements,omitempty"`
 }
 
 type Response struct {
 	Result interface{} `json:"result,omitempty"`
 	Error  string      `json:"error,omitempty"`
 	Took   float64     `json:"took,omitempty"`
+	Index  uint64      `json:"index,omitempty"` // Raft index a write was applied at.
+	// Truncated is set when a query returned more rows than the row or byte
+	// limit let through.
+	Truncated bool `json:"truncated,omitempty"`
 }
 
+// ForwardMode is how a node that is not the leader handles requests that
+// only the leader can serve.
+type ForwardMode string
+
+const (
+	// ForwardProxy sends the request to the leader and returns its response.
+	ForwardProxy ForwardMode = "proxy"
+	// ForwardRedirect answers with a 307 redirect to the leader.
+	ForwardRedirect ForwardMode = "redirect"
+)
+
+// forwardedHeader marks requests proxied from another node, so they are never
+// proxied twice.
+const forwardedHeader = "X-Duckdb-Forwarded-By"
+
+// forwardedForHeader holds the address of the client of a proxied request.
+const forwardedForHeader = "X-Forwarded-For"
+
 // Service provides HTTP service.
 type Service struct {
 	addr string       // Bind address of the HTTP service.
@@ -30,15 +95,38 @@ type Service struct {
 
 	store store.Store // The Raft-backed database store.
 
+	// Forward is how requests for the leader are handed over to it.
+	Forward ForwardMode
+	// LeaderWait is how long a request for the leader waits for one to be
+	// elected before failing with 503.
+	LeaderWait time.Duration
+	// ReadyMaxLag is how many committed entries a node may have yet to apply
+	// and still be ready.
+	ReadyMaxLag uint64
+	// DefaultTimeout bounds requests to /db/execute and /db/query that don't
+	// set a timeout, and MaxTimeout bounds every request. Zero means no bound.
+	DefaultTimeout time.Duration
+	MaxTimeout     time.Duration
+	// MaxRows and MaxBytes bound the rows and the encoded size of the rows
+	// a query returns; requests may only lower them. Zero means no bound.
+	MaxRows  int64
+	MaxBytes int64
+	client   *http.Client // Client for proxied requests.
+
 	start time.Time // Start up time.
 }
 
 // New returns an uninitialized HTTP service.
 func New(addr string, store store.Store) *Service {
 	return &Service{
-		addr:  addr,
-		store: store,
-		start: time.Now(),
+		addr:           addr,
+		store:          store,
+		Forward:        ForwardProxy,
+		ReadyMaxLag:    defaultReadyMaxLag,
+		DefaultTimeout: defaultTimeout,
+		MaxTimeout:     defaultMaxTimeout,
+		client:         &http.Client{},
+		start:          time.Now(),
 	}
 }
 
@@ -50,7 +138,7 @@ func (s *Service) Start() error {
 
 	ln, err := net.Listen("tcp", s.addr)
 	if err != nil {
-		log.Printf("Error starting server: %v", err)
+		slog.Error("failed to start HTTP server", "addr", s.addr, "error", err)
 		return err
 	}
 	s.ln = ln
@@ -58,101 +146,493 @@ func (s *Service) Start() error {
 	go func() {
 		err := server.Serve(s.ln)
 		if err != nil {
-			log.Printf("Error serving HTTP requests: %v", err)
+			slog.Error("failed to serve HTTP requests", "error", err)
 			panic("Failed to start HTTP server")
 		}
 	}()
 
-	log.Printf("Service started on %s", s.addr)
+	slog.Info("HTTP service started", "addr", s.addr)
 	return nil
 }
 
 // Close closes the service.
 func (s *Service) Close() {
 	if err := s.ln.Close(); err != nil {
-		log.Printf("Error closing listener: %v", err)
+		slog.Error("failed to close listener", "error", err)
 	}
-	log.Println("Service stopped")
+	slog.Info("HTTP service stopped")
 }
 
 // ServeHTTP allows Service to serve HTTP requests.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received %s request for %s", r.Method, r.URL.Path)
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	endpoint := s.route(rec, r)
+	d := time.Since(start)
+	metrics.ObserveRequest(endpoint, r.Method, rec.status, d)
+	if endpoint != "livez" && endpoint != "readyz" && endpoint != "metrics" {
+		slog.Debug("handled request", "method", r.Method, "path", r.URL.Path,
+			"status", rec.status, "duration", d)
+	}
+}
+
+// route serves the request and returns the name of the endpoint, which is
+// used as a metrics label.
+func (s *Service) route(w http.ResponseWriter, r *http.Request) string {
+	// Probes and scrapes are frequent, don't log them.
+	switch r.URL.Path {
+	case "/livez":
+		s.handleLivez(w, r)
+		return "livez"
+	case "/readyz":
+		s.handleReadyz(w, r)
+		return "readyz"
+	case "/metrics":
+		metrics.Handler().ServeHTTP(w, r)
+		return "metrics"
+	}
 
 	switch {
+	case strings.HasPrefix(r.URL.Path, "/db/queries"):
+		s.handleQueries(w, r)
+		return "queries"
 	case strings.HasPrefix(r.URL.Path, "/db/execute"):
 		s.handleExecute(w, r)
+		return "execute"
 	case strings.HasPrefix(r.URL.Path, "/db/query"):
 		s.handleQuery(w, r)
+		return "query"
 	case strings.HasPrefix(r.URL.Path, "/join"):
 		s.handleJoin(w, r)
+		return "join"
+	case strings.HasPrefix(r.URL.Path, "/remove"):
+		s.handleRemove(w, r)
+		return "remove"
+	case strings.HasPrefix(r.URL.Path, "/cluster/leader/transfer"):
+		s.handleLeaderTransfer(w, r)
+		return "leader_transfer"
+	case strings.HasPrefix(r.URL.Path, "/cluster/role"):
+		s.handleRole(w, r)
+		return "role"
+	case strings.HasPrefix(r.URL.Path, "/cluster/bootstrap"):
+		s.handleBootstrap(w, r)
+		return "bootstrap"
+	case strings.HasPrefix(r.URL.Path, "/cluster/local"):
+		s.handleLocal(w, r)
+		return "local"
+	case strings.HasPrefix(r.URL.Path, "/cluster/nodes"):
+		s.handleNodes(w, r)
+		return "nodes"
 	case strings.HasPrefix(r.URL.Path, "/status"):
 		s.handleStatus(w, r)
+		return "status"
 	default:
 		w.WriteHeader(http.StatusNotFound)
-		log.Printf("404 Not Found: %s", r.URL.Path)
+		slog.Debug("not found", "path", r.URL.Path)
+		return "other"
 	}
 }
 
+// statusRecorder records the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Roles a node can join the cluster with. Non-voters replicate the log and
+// serve reads but take no part in elections or quorum.
+const (
+	RoleVoter    = "voter"
+	RoleNonvoter = "nonvoter"
+)
+
+// JoinRequest is the body of /join. Addr is the Raft address of the node and
+// Role is RoleVoter (the default) or RoleNonvoter; the remaining fields are
+// the node's metadata.
+type JoinRequest struct {
+	ID            string            `json:"id"`
+	Addr          string            `json:"addr"`
+	Role          string            `json:"role,omitempty"`
+	HTTPAddr      string            `json:"http_addr"`
+	AdvertiseAddr string            `json:"advertise_addr,omitempty"`
+	Version       string            `json:"version,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
 // handleJoin handles cluster-join requests from other nodes.
 func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling join request")
-
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading body: %v", err)
+		slog.Debug("failed to read body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	m := map[string]string{}
-	if err := json.Unmarshal(b, &m); err != nil {
-		log.Printf("Error unmarshalling JSON: %v", err)
+	var jr JoinRequest
+	if err := json.Unmarshal(b, &jr); err != nil {
+		slog.Debug("invalid JSON body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if len(m) != 2 {
-		log.Printf("Invalid join request: expected 2 parameters, got %d", len(m))
+	if jr.HTTPAddr == "" {
+		// Nodes running an earlier version only send their "id|httpAddr"
+		// server ID, so that they can still join during a rolling upgrade.
+		jr.HTTPAddr, _ = store.LegacyHTTPAddr(jr.ID)
+	}
+	if jr.ID == "" || jr.Addr == "" || jr.HTTPAddr == "" {
+		slog.Debug("invalid join request: 'id', 'addr' and 'http_addr' are required")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	voter, err := parseRole(jr.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	meta := store.NodeMeta{
+		HTTPAddr:      jr.HTTPAddr,
+		AdvertiseAddr: jr.AdvertiseAddr,
+		Version:       jr.Version,
+		Tags:          jr.Tags,
+	}
+	if err := s.store.Join(jr.ID, jr.Addr, voter, meta); err != nil {
+		if errors.Is(err, store.ErrNotLeader) {
+			s.forwardToLeader(w, r, b)
+			return
+		}
+		slog.Error("failed to join node", "node", jr.ID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	remoteAddr, ok := m["addr"]
-	if !ok {
-		log.Println("Missing 'addr' in join request")
+	slog.Info("node joined", "node", jr.ID, "addr", jr.Addr)
+}
+
+// handleRemove handles requests to remove a node from the cluster.
+func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.Debug("failed to read body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil || req.ID == "" {
+		slog.Debug("invalid remove request: 'id' is required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.Remove(req.ID)
+	switch {
+	case errors.Is(err, store.ErrNotLeader):
+		s.forwardToLeader(w, r, b)
+	case errors.Is(err, store.ErrNodeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		slog.Error("failed to remove node", "node", req.ID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		slog.Info("node removed", "node", req.ID)
+	}
+}
+
+// handleRole promotes a non-voter to a voter or demotes a voter to a
+// non-voter.
+func (s *Service) handleRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-	nodeID, ok := m["id"]
-	if !ok {
-		log.Println("Missing 'id' in join request")
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.Debug("failed to read body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	var req struct {
+		ID   string `json:"id"`
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil || req.ID == "" || req.Role == "" {
+		slog.Debug("invalid role request: 'id' and 'role' are required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	voter, err := parseRole(req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if err := s.store.Join(nodeID, remoteAddr); err != nil {
-		log.Printf("Error joining node: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	err = s.store.SetVoter(req.ID, voter)
+	switch {
+	case errors.Is(err, store.ErrNotLeader):
+		s.forwardToLeader(w, r, b)
+	case errors.Is(err, store.ErrNodeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		slog.Error("failed to change role of node", "node", req.ID, "role", req.Role, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		slog.Info("changed role of node", "node", req.ID, "role", req.Role)
+	}
+}
+
+// handleLeaderTransfer hands leadership to the node given by the optional
+// "id" of the body, or to any other voter, and returns the new leader.
+func (s *Service) handleLeaderTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.Debug("failed to read body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		ID string `json:"id"`
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			slog.Debug("invalid JSON body", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = s.store.TransferLeadership(req.ID)
+	switch {
+	case errors.Is(err, store.ErrNotLeader):
+		s.forwardToLeader(w, r, b)
+		return
+	case errors.Is(err, store.ErrNodeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, store.ErrNotVoter):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.Error("failed to transfer leadership", "target", req.ID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	leader, err := s.store.WaitForLeader(leaderTransferWait)
+	if err != nil {
+		// Leadership moved, but the new leader has not been heard from yet.
+		writeJSON(w, r, map[string]string{})
+		return
+	}
+	writeJSON(w, r, map[string]string{"leader": leader})
+}
+
+// parseRole reports whether role is RoleVoter or, if empty, defaults to it.
+func parseRole(role string) (bool, error) {
+	switch role {
+	case "", RoleVoter:
+		return true, nil
+	case RoleNonvoter:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid role %q: must be %q or %q", role, RoleVoter, RoleNonvoter)
+	}
+}
+
+// BootstrapInfo is the response of /cluster/bootstrap, which nodes started
+// with a bootstrap peer list exchange to discover each other.
+type BootstrapInfo struct {
+	Node         store.Node `json:"node"`
+	Bootstrapped bool       `json:"bootstrapped"`
+}
+
+// handleBootstrap returns this node's ID, Raft address and metadata, and
+// whether it is part of a cluster already.
+func (s *Service) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	bootstrapped, err := s.store.Bootstrapped()
+	if err != nil {
+		slog.Error("failed to fetch configuration", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, BootstrapInfo{Node: s.store.LocalNode(), Bootstrapped: bootstrapped})
+}
+
+// NodeStatus is a node of the Raft configuration as returned by
+// /cluster/nodes, with its replication state as reported by the node.
+type NodeStatus struct {
+	store.Node
+	HTTPAddr     string     `json:"http_addr,omitempty"`
+	Reachable    bool       `json:"reachable"`
+	AppliedIndex uint64     `json:"applied_index,omitempty"`
+	LastContact  *time.Time `json:"last_contact,omitempty"`
+	// Lag is how many entries the node has yet to apply compared to the
+	// leader. It is omitted when the leader is unknown or unreachable.
+	Lag   *uint64 `json:"lag,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// handleNodes returns the members of the cluster with their metadata and
+// replication state, fetched from every node in parallel.
+func (s *Service) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	log.Printf("Node %s joined with address %s", nodeID, remoteAddr)
+	nodes, err := s.store.Nodes()
+	if err != nil {
+		slog.Error("failed to fetch nodes", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	local := s.store.LocalNode()
+	statuses := make([]NodeStatus, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		statuses[i] = NodeStatus{Node: n, HTTPAddr: n.Meta.Addr()}
+		wg.Add(1)
+		go func(ns *NodeStatus) {
+			defer wg.Done()
+			var state store.LocalState
+			var err error
+			if ns.ID == local.ID {
+				state = s.store.LocalState()
+			} else if ns.HTTPAddr == "" {
+				ns.Error = "HTTP address unknown"
+				return
+			} else if state, err = s.fetchLocalState(r.Context(), ns.HTTPAddr); err != nil {
+				ns.Error = err.Error()
+				return
+			}
+			ns.Reachable = true
+			ns.AppliedIndex = state.AppliedIndex
+			ns.LastContact = state.LastContact
+		}(&statuses[i])
+	}
+	wg.Wait()
+
+	for _, leader := range statuses {
+		if !leader.Leader || !leader.Reachable {
+			continue
+		}
+		for i := range statuses {
+			if statuses[i].Reachable {
+				var lag uint64
+				if leader.AppliedIndex > statuses[i].AppliedIndex {
+					lag = leader.AppliedIndex - statuses[i].AppliedIndex
+				}
+				statuses[i].Lag = &lag
+			}
+		}
+	}
+
+	writeJSON(w, r, map[string]interface{}{"nodes": statuses})
+}
+
+// handleLocal returns the replication state of this node.
+func (s *Service) handleLocal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, s.store.LocalState())
+}
+
+// fetchLocalState fetches the replication state of the node at addr.
+func (s *Service) fetchLocalState(ctx context.Context, addr string) (store.LocalState, error) {
+	var state store.LocalState
+	ctx, cancel := context.WithTimeout(ctx, nodeStateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/cluster/local", addr), nil)
+	if err != nil {
+		return state, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return state, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
+
+// handleLivez reports that the process is up and serving HTTP.
+func (s *Service) handleLivez(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz reports whether the node should receive traffic: a leader is
+// known and the node has applied all but ReadyMaxLag committed entries. With
+// the "leader" query param the node must also be the leader, for pools that
+// only send writes to it.
+func (s *Service) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := s.store.LocalState()
+	if _, err := s.store.Leader(); err != nil {
+		http.Error(w, "not ready: no leader", http.StatusServiceUnavailable)
+		return
+	}
+	if state.CommitIndex > state.AppliedIndex && state.CommitIndex-state.AppliedIndex > s.ReadyMaxLag {
+		http.Error(w, fmt.Sprintf("not ready: applied index %d is behind commit index %d",
+			state.AppliedIndex, state.CommitIndex), http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Has("leader") && !state.Leader {
+		http.Error(w, "not ready: not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
 }
 
 // handleStatus returns status on the system.
 func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		log.Printf("Invalid method %s for /status", r.Method)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	log.Println("Handling status request")
-
 	results, err := s.store.Stats()
 	if err != nil {
-		log.Printf("Error fetching stats: %v", err)
+		slog.Error("failed to fetch stats", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -181,12 +661,12 @@ func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 		b, err = json.Marshal(status)
 	}
 	if err != nil {
-		log.Printf("Error marshalling status response: %v", err)
+		slog.Error("failed to marshal status", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
 		_, err = w.Write([]byte(b))
 		if err != nil {
-			log.Printf("Error writing status response: %v", err)
+			slog.Debug("failed to write response", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	}
@@ -194,19 +674,27 @@ func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 // handleExecute handles queries that modify the database.
 func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling execute request")
 
 	if r.Method != "POST" {
-		log.Printf("Invalid method %s for /db/execute", r.Method)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		http.Error(w, "Only Post is Allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	ctx, cancel, err := s.requestContext(r)
+	if err != nil {
+		slog.Debug("invalid timeout", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	resp := Response{}
 	start := time.Now()
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading body: %v", err)
+		slog.Debug("failed to read body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -214,50 +702,92 @@ func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 
 	var clientRequest ClientRequest
 	if err := json.Unmarshal(b, &clientRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
+		slog.Debug("invalid JSON body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	query := clientRequest.SQL
-	if query == "" {
-		log.Println("Empty SQL query")
-		http.Error(w, "SQL query is empty", http.StatusBadRequest)
-		return
+	var result interface{}
+	var index uint64
+	if len(clientRequest.Statements) > 0 {
+		if clientRequest.SQL != "" {
+			slog.Debug("both sql and statements set")
+			http.Error(w, "Only one of sql and statements may be set", http.StatusBadRequest)
+			return
+		}
+		for i, stmt := range clientRequest.Statements {
+			if stmt.SQL == "" {
+				slog.Debug("empty SQL in statement", "statement", i+1)
+				http.Error(w, fmt.Sprintf("SQL of statement %d is empty", i+1), http.StatusBadRequest)
+				return
+			}
+		}
+		result, index, err = s.store.ExecuteBatch(ctx, clientRequest.Statements)
+	} else {
+		query := clientRequest.SQL
+		if query == "" {
+			slog.Debug("empty SQL query")
+			http.Error(w, "SQL query is empty", http.StatusBadRequest)
+			return
+		}
+		result, index, err = s.store.Execute(ctx, db.Statement{SQL: query, Params: clientRequest.Params})
 	}
-
-	result, err := s.store.Execute(query)
 	if err != nil {
 		if err == store.ErrNotLeader {
-			url := fmt.Sprintf("http://%s%s", s.store.Leader(), r.URL.Path)
-			http.Redirect(w, r, url, http.StatusMovedPermanently)
+			s.forwardToLeader(w, r, b)
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			slog.Debug("client went away", "path", r.URL.Path, "error", err)
 			return
 		}
 		resp.Error = err.Error()
-		log.Printf("Error executing query: %v", err)
+		slog.Debug("execute failed", "error", err)
 	} else {
 		resp.Result = result
 	}
+	resp.Index = index
 	resp.Took = float64(time.Since(start).Milliseconds())
 	writeResponse(w, r, &resp)
 }
 
 // handleQuery handles queries that do not modify the database.
 func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling query request")
 
 	if r.Method != "GET" && r.Method != "POST" {
-		log.Printf("Invalid method %s for /db/query", r.Method)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	opts, err := queryOptions(r)
+	if err != nil {
+		slog.Debug("invalid query options", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resultOpts, err := parseResultOptions(r, s.MaxRows, s.MaxBytes)
+	if err != nil {
+		slog.Debug("invalid result options", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := s.requestContext(r)
+	if err != nil {
+		slog.Debug("invalid timeout", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	ctx = db.WithQueryInfo(ctx, db.QueryInfo{Client: clientAddr(r), Level: opts.Level.String()})
+	r = r.WithContext(ctx)
+
 	resp := Response{}
 	start := time.Now()
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading body: %v", err)
+		slog.Debug("failed to read body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -265,22 +795,45 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	var clientRequest ClientRequest
 	if err := json.Unmarshal(b, &clientRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
+		slog.Debug("invalid JSON body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	query := clientRequest.SQL
 	if query == "" {
-		log.Println("Empty SQL query")
+		slog.Debug("empty SQL query")
 		http.Error(w, "SQL query is empty", http.StatusBadRequest)
 		return
 	}
 
-	result, err := s.store.Query(query)
+	stmt := db.Statement{SQL: query, Params: clientRequest.Params}
+	if resultOpts.Format != "" {
+		s.streamQuery(w, r, b, stmt, opts, resultOpts, start)
+		return
+	}
+
+	result := newBufferedResult(resultOpts)
+	err = s.store.QueryRows(ctx, stmt, opts, result)
+	if err == errRowLimit {
+		resp.Truncated = true
+		err = nil
+	}
 	if err != nil {
+		if err == store.ErrNotLeader || err == store.ErrStaleRead {
+			s.forwardToLeader(w, r, b)
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			slog.Debug("client went away", "path", r.URL.Path, "error", err)
+			return
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			// DuckDB reports the interrupted query as such, name the cause.
+			err = fmt.Errorf("query timed out: %w", err)
+		}
 		resp.Error = err.Error()
-		log.Printf("Error querying database: %v", err)
+		slog.Debug("query failed", "error", err)
 	} else {
 		resp.Result = result
 	}
@@ -288,14 +841,236 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, r, &resp)
 }
 
+// streamQuery runs a read and writes its rows as they are read. Once the
+// columns are written the status can no longer change, so errors are
+// reported in the trailer.
+func (s *Service) streamQuery(w http.ResponseWriter, r *http.Request, body []byte,
+	stmt db.Statement, opts store.QueryOptions, resultOpts resultOptions, start time.Time) {
+	ctx := r.Context()
+	sw := newStreamWriter(w, resultOpts)
+	err := s.store.QueryRows(ctx, stmt, opts, sw)
+	if err != nil {
+		if err == store.ErrNotLeader || err == store.ErrStaleRead {
+			s.forwardToLeader(w, r, body)
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			slog.Debug("client went away", "path", r.URL.Path, "rows", sw.limit.rows, "error", err)
+			return
+		}
+		if err == errRowLimit {
+			err = nil
+		} else {
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("query timed out: %w", err)
+			}
+			slog.Debug("query failed", "rows", sw.limit.rows, "error", err)
+		}
+	}
+	sw.finish(err, time.Since(start))
+}
+
+// handleQueries lists the statements executing on this node, or kills one
+// with DELETE /db/queries/{id}.
+func (s *Service) handleQueries(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/db/queries"), "/")
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, r, map[string]interface{}{"queries": s.store.Queries()})
+	case r.Method == "DELETE" && id != "":
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid query ID %q", id), http.StatusBadRequest)
+			return
+		}
+		err = s.store.KillQuery(n)
+		switch {
+		case errors.Is(err, db.ErrQueryNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, db.ErrNotKillable):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			slog.Error("failed to kill query", "query", n, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			slog.Info("killed query", "query", n)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// clientAddr returns the address of the client of the request, which is
+// the original client for requests proxied from another node.
+func clientAddr(r *http.Request) string {
+	if r.Header.Get(forwardedHeader) != "" {
+		if addr := r.Header.Get(forwardedForHeader); addr != "" {
+			return addr
+		}
+	}
+	return r.RemoteAddr
+}
+
+// forwardToLeader hands a request that must be served by the leader over to
+// it, either by proxying it with its body and relaying the response, or by
+// redirecting the client.
+func (s *Service) forwardToLeader(w http.ResponseWriter, r *http.Request, body []byte) {
+	// The leader changed while the request was forwarded; let the client retry.
+	if s.Forward == ForwardProxy && r.Header.Get(forwardedHeader) != "" {
+		slog.Warn("not leader for forwarded request", "path", r.URL.Path)
+		writeUnavailable(w, store.ErrNotLeader)
+		return
+	}
+
+	if _, ok := r.Context().Deadline(); !ok {
+		ctx, cancel := context.WithTimeout(r.Context(), forwardTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	deadline := time.Now().Add(s.LeaderWait)
+	for {
+		leader, err := s.store.WaitForLeader(time.Until(deadline))
+		if err != nil {
+			slog.Warn("no leader to forward request to", "path", r.URL.Path, "error", err)
+			writeUnavailable(w, err)
+			return
+		}
+
+		u := url.URL{
+			Scheme:   "http",
+			Host:     leader,
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+
+		if s.Forward == ForwardRedirect {
+			// Unlike 301, 307 tells clients to repeat the request with the same method and body.
+			http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+			return
+		}
+
+		resp, err := s.proxy(r, u.String(), body)
+		if err != nil {
+			switch r.Context().Err() {
+			case context.Canceled:
+				slog.Debug("client went away", "path", r.URL.Path, "error", err)
+				return
+			case context.DeadlineExceeded:
+				slog.Debug("forwarded request timed out", "leader", u.Host, "error", err)
+				http.Error(w, "timed out waiting for the leader", http.StatusGatewayTimeout)
+				return
+			}
+			slog.Error("failed to forward request to leader", "leader", u.Host, "error", err)
+			// A leader that just went down refuses connections until the
+			// others notice and elect a new one. The request never reached
+			// it, so it is safe to try again.
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				if time.Now().Before(deadline) {
+					time.Sleep(leaderRetryInterval)
+					continue
+				}
+				writeUnavailable(w, err)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		if err := relay(w, resp.Body); err != nil {
+			slog.Debug("failed to relay response from leader", "error", err)
+		}
+		return
+	}
+}
+
+// relay copies the response of the leader to w, flushing what it has read so
+// far so that streamed responses reach the client as the leader writes them.
+func relay(w http.ResponseWriter, body io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// proxy sends a copy of the request with the given body to url.
+func (s *Service) proxy(r *http.Request, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(forwardedHeader, s.addr)
+	req.Header.Set(forwardedForHeader, clientAddr(r))
+	// The leader gets what is left of the time this node was given.
+	if deadline, ok := r.Context().Deadline(); ok {
+		q := req.URL.Query()
+		q.Set("timeout", time.Until(deadline).String())
+		req.URL.RawQuery = q.Encode()
+	}
+	return s.client.Do(req)
+}
+
+// requestContext returns the context of a request to /db/execute or
+// /db/query, which is done when the client goes away or, at the latest, once
+// the timeout query param, DefaultTimeout or MaxTimeout has passed.
+func (s *Service) requestContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := s.DefaultTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, nil, fmt.Errorf("invalid timeout %q", v)
+		}
+		timeout = d
+	}
+	if s.MaxTimeout > 0 && (timeout <= 0 || timeout > s.MaxTimeout) {
+		timeout = s.MaxTimeout
+	}
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// writeUnavailable tells the client to retry once the cluster has a leader.
+func writeUnavailable(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
 }
 
 func writeResponse(w http.ResponseWriter, r *http.Request, j *Response) {
-	log.Println("Writing response")
+	writeJSON(w, r, j)
+}
 
+// writeJSON writes v as JSON, indented if the request asks for pretty output.
+func writeJSON(w http.ResponseWriter, r *http.Request, j interface{}) {
 	var b []byte
 	var err error
 	pretty, _ := isPretty(r)
@@ -307,22 +1082,62 @@ func writeResponse(w http.ResponseWriter, r *http.Request, j *Response) {
 	}
 
 	if err != nil {
-		log.Printf("Error marshalling response: %v", err)
+		slog.Error("failed to marshal response", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	_, err = w.Write(b)
 	if err != nil {
-		log.Printf("Error writing response: %v", err)
+		slog.Debug("failed to write response", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// queryOptions parses the level, min_index, max_staleness and max_lag query
+// params of a read.
+func queryOptions(r *http.Request) (store.QueryOptions, error) {
+	q := r.URL.Query()
+	opts := store.QueryOptions{
+		MinIndexTimeout: minIndexTimeout,
+	}
+
+	level, err := store.ParseConsistencyLevel(q.Get("level"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Level = level
+
+	if v := q.Get("min_index"); v != "" {
+		idx, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid min_index %q", v)
+		}
+		opts.MinIndex = idx
+	}
+
+	if v := q.Get("max_staleness"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid max_staleness %q", v)
+		}
+		opts.MaxStaleness = d
+	}
+
+	if v := q.Get("max_lag"); v != "" {
+		lag, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid max_lag %q", v)
+		}
+		opts.MaxLag = lag
+	}
+	return opts, nil
+}
+
 // queryParam returns whether the given query param is set to true.
 func queryParam(req *http.Request, param string) (bool, error) {
 	err := req.ParseForm()
 	if err != nil {
-		log.Printf("Error parsing form: %v", err)
+		slog.Debug("failed to parse form", "error", err)
 		return false, err
 	}
 	if _, ok := req.Form[param]; ok {
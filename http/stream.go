@@ -0,0 +1,250 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StreamFormat is how /db/query streams the rows of a query.
+type StreamFormat string
+
+const (
+	// StreamJSON writes one JSON document shaped like the buffered response,
+	// with the values array written row by row and the trailer fields after
+	// the result.
+	StreamJSON StreamFormat = "json"
+	// StreamNDJSON writes a line with the columns, a JSON array per row, and
+	// a trailer line.
+	StreamNDJSON StreamFormat = "ndjson"
+)
+
+// How often a stream is flushed to the client while rows are written. The
+// columns and the trailer are flushed right away.
+const streamFlushInterval = 100 * time.Millisecond
+
+// errRowLimit stops a query once it reached its row or byte limit.
+var errRowLimit = errors.New("row limit reached")
+
+// resultOptions are the stream, max_rows and max_bytes query params of a
+// read. The limits apply whether or not the result is streamed.
+type resultOptions struct {
+	Format   StreamFormat // Empty if the response is not streamed.
+	MaxRows  int64
+	MaxBytes int64
+}
+
+// parseResultOptions parses the result options of a read. The limits of the
+// request may lower maxRows and maxBytes but not raise them; zero means no
+// limit.
+func parseResultOptions(r *http.Request, maxRows, maxBytes int64) (resultOptions, error) {
+	q := r.URL.Query()
+	opts := resultOptions{MaxRows: maxRows, MaxBytes: maxBytes}
+	if q.Has("stream") {
+		switch f := StreamFormat(q.Get("stream")); f {
+		case "", StreamJSON:
+			opts.Format = StreamJSON
+		case StreamNDJSON:
+			opts.Format = StreamNDJSON
+		default:
+			return opts, fmt.Errorf("invalid stream %q: must be %q or %q", f, StreamJSON, StreamNDJSON)
+		}
+	}
+
+	for _, l := range []struct {
+		param string
+		limit *int64
+	}{{"max_rows", &opts.MaxRows}, {"max_bytes", &opts.MaxBytes}} {
+		v := q.Get(l.param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid %s %q", l.param, v)
+		}
+		if *l.limit == 0 || n < *l.limit {
+			*l.limit = n
+		}
+	}
+	return opts, nil
+}
+
+// rowLimit counts the rows of a result and their encoded size.
+type rowLimit struct {
+	maxRows   int64
+	maxBytes  int64
+	rows      int64
+	bytes     int64
+	truncated bool
+}
+
+// add counts a row of n encoded bytes, or returns errRowLimit if it does not
+// fit in the limits.
+func (l *rowLimit) add(n int) error {
+	if (l.maxRows > 0 && l.rows >= l.maxRows) || (l.maxBytes > 0 && l.bytes+int64(n) > l.maxBytes) {
+		l.truncated = true
+		return errRowLimit
+	}
+	l.rows++
+	l.bytes += int64(n)
+	return nil
+}
+
+// bufferedResult is the result of a read that is not streamed. Rows are
+// kept encoded, so that their size counts against the byte limit and they
+// are not encoded twice. It implements db.RowWriter.
+type bufferedResult struct {
+	Columns []string          `json:"columns,omitempty"`
+	Types   []string          `json:"types,omitempty"`
+	Values  []json.RawMessage `json:"values,omitempty"`
+	limit   rowLimit
+}
+
+func newBufferedResult(opts resultOptions) *bufferedResult {
+	return &bufferedResult{limit: rowLimit{maxRows: opts.MaxRows, maxBytes: opts.MaxBytes}}
+}
+
+func (br *bufferedResult) WriteColumns(columns, types []string) error {
+	br.Columns, br.Types = columns, types
+	return nil
+}
+
+func (br *bufferedResult) WriteRow(values []interface{}) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := br.limit.add(len(b)); err != nil {
+		return err
+	}
+	br.Values = append(br.Values, b)
+	return nil
+}
+
+// streamTrailer ends a streamed response.
+type streamTrailer struct {
+	Rows int64 `json:"rows"`
+	// Truncated is set when the query returned more rows than the row or
+	// byte limit let through.
+	Truncated bool    `json:"truncated,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Took      float64 `json:"took"`
+}
+
+// streamWriter writes the rows of a query to the client as they are read.
+// It implements db.RowWriter.
+type streamWriter struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	format    StreamFormat
+	started   bool // Whether the columns have been written.
+	limit     rowLimit
+	lastFlush time.Time
+}
+
+func newStreamWriter(w http.ResponseWriter, opts resultOptions) *streamWriter {
+	return &streamWriter{
+		w:      w,
+		rc:     http.NewResponseController(w),
+		format: opts.Format,
+		limit:  rowLimit{maxRows: opts.MaxRows, maxBytes: opts.MaxBytes},
+	}
+}
+
+func (sw *streamWriter) WriteColumns(columns, types []string) error {
+	header := struct {
+		Columns []string `json:"columns"`
+		Types   []string `json:"types"`
+	}{columns, types}
+	b, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	if sw.format == StreamNDJSON {
+		sw.w.Header().Set("Content-Type", "application/x-ndjson")
+		b = append(b, '\n')
+	} else {
+		sw.w.Header().Set("Content-Type", "application/json")
+		// Leave the result object open for the values.
+		b = append([]byte(`{"result":`), b[:len(b)-1]...)
+		b = append(b, `,"values":[`...)
+	}
+	sw.started = true
+	if _, err := sw.w.Write(b); err != nil {
+		return err
+	}
+	return sw.flush()
+}
+
+func (sw *streamWriter) WriteRow(values []interface{}) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	if sw.format == StreamNDJSON {
+		b = append(b, '\n')
+	} else if sw.limit.rows > 0 {
+		b = append([]byte(",\n"), b...)
+	}
+	if err := sw.limit.add(len(b)); err != nil {
+		return err
+	}
+
+	if _, err := sw.w.Write(b); err != nil {
+		return err
+	}
+	if time.Since(sw.lastFlush) >= streamFlushInterval {
+		return sw.flush()
+	}
+	return nil
+}
+
+// finish writes the trailer with the error the query failed with, if any.
+// If the query failed before any column was written, the trailer is the
+// whole response.
+func (sw *streamWriter) finish(queryErr error, took time.Duration) {
+	trailer := streamTrailer{
+		Rows:      sw.limit.rows,
+		Truncated: sw.limit.truncated,
+		Took:      float64(took.Milliseconds()),
+	}
+	if queryErr != nil {
+		trailer.Error = queryErr.Error()
+	}
+	b, err := json.Marshal(trailer)
+	if err != nil {
+		slog.Error("failed to marshal trailer", "error", err)
+		return
+	}
+
+	if sw.format == StreamNDJSON {
+		if !sw.started {
+			sw.w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		b = append(b, '\n')
+	} else if sw.started {
+		// Close the values and the result, and add the trailer fields to
+		// the top-level object.
+		b = append([]byte("]},"), b[1:]...)
+	}
+	if _, err := sw.w.Write(b); err != nil {
+		slog.Debug("failed to write response", "error", err)
+		return
+	}
+	sw.flush()
+}
+
+func (sw *streamWriter) flush() error {
+	sw.lastFlush = time.Now()
+	if err := sw.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseResultOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		maxRows  int64 // Server limits.
+		maxBytes int64
+		want     resultOptions
+		err      bool
+	}{
+		{"default", "", 0, 0, resultOptions{}, false},
+		{"server limits", "", 10, 100, resultOptions{MaxRows: 10, MaxBytes: 100}, false},
+		{"stream", "stream", 0, 0, resultOptions{Format: StreamJSON}, false},
+		{"stream json", "stream=json", 0, 0, resultOptions{Format: StreamJSON}, false},
+		{"stream ndjson", "stream=ndjson", 0, 0, resultOptions{Format: StreamNDJSON}, false},
+		{"stream csv", "stream=csv", 0, 0, resultOptions{}, true},
+		{"lower limits", "max_rows=5&max_bytes=50", 10, 100, resultOptions{MaxRows: 5, MaxBytes: 50}, false},
+		{"higher limits", "max_rows=50&max_bytes=500", 10, 100, resultOptions{MaxRows: 10, MaxBytes: 100}, false},
+		{"no server limits", "max_rows=5&max_bytes=50", 0, 0, resultOptions{MaxRows: 5, MaxBytes: 50}, false},
+		{"zero rows", "max_rows=0", 0, 0, resultOptions{}, true},
+		{"negative bytes", "max_bytes=-1", 0, 0, resultOptions{}, true},
+		{"invalid rows", "max_rows=ten", 0, 0, resultOptions{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/db/query?"+tt.query, nil)
+			got, err := parseResultOptions(r, tt.maxRows, tt.maxBytes)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseResultOptions(%q) = %+v, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResultOptions(%q) error = %v", tt.query, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseResultOptions(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRowLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxRows       int64
+		maxBytes      int64
+		sizes         []int // Encoded size of every row.
+		wantRows      int64
+		wantTruncated bool
+	}{
+		{"no limits", 0, 0, []int{10, 10, 10}, 3, false},
+		{"under row limit", 3, 0, []int{10, 10, 10}, 3, false},
+		{"row limit", 2, 0, []int{10, 10, 10}, 2, true},
+		{"byte limit exactly", 0, 30, []int{10, 10, 10}, 3, false},
+		{"byte limit", 0, 25, []int{10, 10, 10}, 2, true},
+		{"first row too large", 0, 5, []int{10}, 0, true},
+		{"both limits", 2, 15, []int{10, 10}, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := rowLimit{maxRows: tt.maxRows, maxBytes: tt.maxBytes}
+			var err error
+			for _, n := range tt.sizes {
+				if err = l.add(n); err != nil {
+					break
+				}
+			}
+			if tt.wantTruncated != errors.Is(err, errRowLimit) {
+				t.Errorf("add() error = %v, want truncated %v", err, tt.wantTruncated)
+			}
+			if l.rows != tt.wantRows || l.truncated != tt.wantTruncated {
+				t.Errorf("rows = %d, truncated = %v, want %d, %v", l.rows, l.truncated, tt.wantRows, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestBufferedResultLimit(t *testing.T) {
+	br := newBufferedResult(resultOptions{MaxRows: 2})
+	if err := br.WriteColumns([]string{"a"}, []string{"INTEGER"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := br.WriteRow([]interface{}{i}); err != nil {
+			t.Fatalf("WriteRow(%d) error = %v", i, err)
+		}
+	}
+	if err := br.WriteRow([]interface{}{3}); err != errRowLimit {
+		t.Fatalf("WriteRow(3) error = %v, want errRowLimit", err)
+	}
+
+	b, err := json.Marshal(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"columns":["a"],"types":["INTEGER"],"values":[[1],[2]]}`; string(b) != want {
+		t.Errorf("result = %s, want %s", b, want)
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		opts resultOptions
+		rows int
+		err  error // Error the query fails with.
+		want string
+	}{
+		{
+			"json", resultOptions{Format: StreamJSON}, 2, nil,
+			`{"result":{"columns":["a"],"types":["INTEGER"],"values":[[1],` + "\n" + `[2]]},"rows":2,"took":0}`,
+		},
+		{
+			"json row limit", resultOptions{Format: StreamJSON, MaxRows: 2}, 3, nil,
+			`{"result":{"columns":["a"],"types":["INTEGER"],"values":[[1],` + "\n" + `[2]]},"rows":2,"truncated":true,"took":0}`,
+		},
+		{
+			// [1] is 3 bytes, and every further row 2 more for the separator.
+			"json byte limit", resultOptions{Format: StreamJSON, MaxBytes: 8}, 3, nil,
+			`{"result":{"columns":["a"],"types":["INTEGER"],"values":[[1],` + "\n" + `[2]]},"rows":2,"truncated":true,"took":0}`,
+		},
+		{
+			"json error", resultOptions{Format: StreamJSON}, 1, errors.New("boom"),
+			`{"result":{"columns":["a"],"types":["INTEGER"],"values":[[1]]},"rows":1,"error":"boom","took":0}`,
+		},
+		{
+			"ndjson row limit", resultOptions{Format: StreamNDJSON, MaxRows: 2}, 3, nil,
+			`{"columns":["a"],"types":["INTEGER"]}` + "\n[1]\n[2]\n" + `{"rows":2,"truncated":true,"took":0}` + "\n",
+		},
+		{
+			// [1]\n is 4 bytes.
+			"ndjson byte limit", resultOptions{Format: StreamNDJSON, MaxBytes: 11}, 3, nil,
+			`{"columns":["a"],"types":["INTEGER"]}` + "\n[1]\n[2]\n" + `{"rows":2,"truncated":true,"took":0}` + "\n",
+		},
+		{
+			"error before columns", resultOptions{Format: StreamJSON}, -1, errors.New("syntax error"),
+			`{"rows":0,"error":"syntax error","took":0}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			sw := newStreamWriter(rec, tt.opts)
+			err := tt.err
+			if tt.rows >= 0 {
+				if err := sw.WriteColumns([]string{"a"}, []string{"INTEGER"}); err != nil {
+					t.Fatal(err)
+				}
+				for i := 1; i <= tt.rows; i++ {
+					if werr := sw.WriteRow([]interface{}{i}); werr != nil {
+						if werr != errRowLimit {
+							t.Fatalf("WriteRow(%d) error = %v", i, werr)
+						}
+						break
+					}
+				}
+			}
+			sw.finish(err, 0)
+
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("response = %q, want %q", got, tt.want)
+			}
+			if tt.opts.Format == StreamJSON && !json.Valid(rec.Body.Bytes()) {
+				t.Errorf("response is not valid JSON: %s", rec.Body.String())
+			}
+		})
+	}
+}
@@ -3,28 +3,90 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/NamanMahor/duckdb-service/db"
 	httpd "github.com/NamanMahor/duckdb-service/http"
+	"github.com/NamanMahor/duckdb-service/metrics"
 	"github.com/NamanMahor/duckdb-service/store"
 )
 
 var httpAddr string   // http server address host:port
 var raftAddr string   // raft communication address host:port
 var leaderAddr string // leader address only pass by follower
-var nodeID string     // nodeId
+var joinAddrs string  // comma-separated http addresses of nodes to join through
+var joinAttempts int
+var joinInterval time.Duration
+var leaveOnTerminate bool
+var nonvoter bool
+var readyMaxLag uint64
+var nodeID string // nodeId
+var snapshotFormat string
+var forwardMode string
+var leaderWait time.Duration
+var httpAdvAddr string // http address advertised to clients, if different
+var nodeTags string
+var deadNodeTimeout time.Duration
+var bootstrapServers string // http addresses of every node of a new cluster
+var deadNodeAction string
+var logLevel string
+var logFormat string
+var logSQL bool
+var defaultTimeout time.Duration
+var maxTimeout time.Duration
+var maxRows int64
+var maxBytes int64
+
+const (
+	// How often a bootstrapping node polls its peers.
+	bootstrapInterval = time.Second
+
+	// Upper bound of the backoff between join attempts.
+	maxJoinInterval = 30 * time.Second
+
+	// How long a node leaving the cluster on shutdown tries to be removed.
+	leaveTimeout = 10 * time.Second
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 func init() {
 	flag.StringVar(&httpAddr, "http", "localhost:9301", "HTTP query server bind address")
+	flag.StringVar(&httpAdvAddr, "http-adv", "", "HTTP address other nodes and clients should use, if different from -http")
 	flag.StringVar(&raftAddr, "raft", "localhost:9302", "Raft communication bind address")
-	flag.StringVar(&leaderAddr, "leader", "", "host:port of leader to join")
+	flag.StringVar(&leaderAddr, "leader", "", "host:port of leader to join (deprecated, use -join)")
+	flag.StringVar(&joinAddrs, "join", "", "Comma-separated host:port HTTP addresses of cluster nodes to join through")
+	flag.IntVar(&joinAttempts, "join-attempts", 5, "Number of times to try each -join address before giving up")
+	flag.DurationVar(&joinInterval, "join-interval", time.Second, "Wait between join attempts, doubled after every attempt up to 30s")
+	flag.Uint64Var(&readyMaxLag, "ready-max-lag", 100, "How many committed log entries a node may have yet to apply and still report ready on /readyz")
+	flag.BoolVar(&nonvoter, "nonvoter", false, "Join as a non-voting read replica, which receives the log and serves reads but never votes")
+	flag.BoolVar(&leaveOnTerminate, "leave-on-terminate", false, "Leave the cluster on SIGINT or SIGTERM, handing off leadership first if this node is the leader")
 	flag.StringVar(&nodeID, "id", "", "Node ID")
+	flag.StringVar(&nodeTags, "tags", "", "Comma-separated key=value tags stored with the node's metadata")
+	flag.StringVar(&snapshotFormat, "snapshot-format", string(store.SnapshotFile), "Snapshot format: file (copy of the DuckDB file) or parquet (portable export)")
+	flag.StringVar(&forwardMode, "forward", string(httpd.ForwardProxy), "How followers hand writes to the leader: proxy (forward and return the leader's response) or redirect (307)")
+	flag.DurationVar(&leaderWait, "leader-wait", 0, "How long writes wait for a leader to be elected before failing with 503")
+	flag.StringVar(&bootstrapServers, "bootstrap-servers", "", "Comma-separated HTTP addresses of every node of a new cluster, including this one; run the same command on each")
+	flag.DurationVar(&deadNodeTimeout, "dead-node-timeout", 0, "How long a node may be unreachable before the leader removes or demotes it (0 disables)")
+	flag.StringVar(&deadNodeAction, "dead-node-action", string(store.DeadNodeRemove), "What the leader does to dead nodes: remove or demote")
+	flag.DurationVar(&defaultTimeout, "default-timeout", time.Minute, "Timeout of /db/execute and /db/query requests that don't set one (0 disables)")
+	flag.DurationVar(&maxTimeout, "max-timeout", 10*time.Minute, "Upper bound of the timeout of /db/execute and /db/query requests (0 disables)")
+	flag.Int64Var(&maxRows, "max-rows", 0, "Upper bound of the rows of a /db/query response (0 disables)")
+	flag.Int64Var(&maxBytes, "max-bytes", 0, "Upper bound of the encoded size of the rows of a /db/query response, in bytes (0 disables)")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	flag.BoolVar(&logSQL, "log-sql", false, "Log every executed statement, with string and number literals replaced by ?")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\n%s\n\n", "duckdb service to support read write repilca")
 		fmt.Fprintf(os.Stderr, "Usage: %s [arguments] <data directory>\n", os.Args[0])
@@ -41,57 +103,329 @@ func main() {
 		os.Exit(1)
 	}
 
+	logger, err := newLogger(logLevel, logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	db.LogSQL = logSQL
+
 	dataPath := flag.Arg(0)
 
 	// Create and open the store.
 	basePath, err := filepath.Abs(dataPath)
 	if err != nil {
-		log.Fatalf("failed to determine absolute data path: %s", err.Error())
+		fatal("failed to determine absolute data path", "error", err)
+	}
+
+	forward := httpd.ForwardMode(forwardMode)
+	if forward != httpd.ForwardProxy && forward != httpd.ForwardRedirect {
+		fatal("invalid forward mode", "forward", forwardMode)
+	}
+
+	action := store.DeadNodeAction(deadNodeAction)
+	if action != store.DeadNodeRemove && action != store.DeadNodeDemote {
+		fatal("invalid dead node action", "action", deadNodeAction)
+	}
+
+	if nodeID == "" {
+		fatal("node ID is required")
+	}
+
+	tags, err := parseTags(nodeTags)
+	if err != nil {
+		fatal("invalid tags", "error", err)
+	}
+
+	var joins []string
+	if joinAddrs != "" {
+		joins = strings.Split(joinAddrs, ",")
+	}
+	if leaderAddr != "" {
+		joins = append(joins, leaderAddr)
+	}
+
+	if nonvoter && joins == nil {
+		fatal("-nonvoter requires -join")
+	}
+
+	var peers []string
+	if bootstrapServers != "" {
+		if joins != nil {
+			fatal("-bootstrap-servers and -join are mutually exclusive")
+		}
+		peers = strings.Split(bootstrapServers, ",")
+	}
+
+	format := store.SnapshotFormat(snapshotFormat)
+	if format != store.SnapshotFile && format != store.SnapshotParquet {
+		fatal("invalid snapshot format", "format", snapshotFormat)
+	}
+
+	meta := store.NodeMeta{
+		HTTPAddr:      httpAddr,
+		AdvertiseAddr: httpAdvAddr,
+		Version:       version,
+		Tags:          tags,
+	}
+
+	if err := metrics.Init(); err != nil {
+		fatal("failed to initialize metrics", "error", err)
 	}
 
 	store := store.New(basePath, raftAddr)
+	store.SnapshotFormat = format
+	store.Meta = meta
+	store.DeadNodeTimeout = deadNodeTimeout
+	store.DeadNodeAction = action
 
-	isLeader := (leaderAddr == "")
-	serverID := nodeID + "|" + httpAddr
-	err = store.Open(isLeader, serverID)
+	isLeader := (joins == nil && peers == nil)
+	err = store.Open(isLeader, nodeID)
 	if err != nil {
-		log.Fatalf("failed to open store: %s", err.Error())
+		fatal("failed to open store", "error", err)
 	}
+	// Nodes upgraded from an earlier version keep their old server ID.
+	nodeID = store.LocalNode().ID
 
 	// If join was specified, make the join request.
-	if !isLeader {
-		if err := join(leaderAddr, raftAddr, serverID); err != nil {
-			log.Fatalf("failed to join node at %s: %s", leaderAddr, err.Error())
+	if joins != nil {
+		if err := joinCluster(joins, joinAttempts, joinInterval, raftAddr, nodeID, meta); err != nil {
+			fatal("failed to join cluster", "error", err)
 		}
 	}
 
 	// Create the HTTP query server.
 	s := httpd.New(httpAddr, store)
+	s.Forward = forward
+	s.LeaderWait = leaderWait
+	s.ReadyMaxLag = readyMaxLag
+	s.DefaultTimeout = defaultTimeout
+	s.MaxTimeout = maxTimeout
+	s.MaxRows = maxRows
+	s.MaxBytes = maxBytes
 	if err := s.Start(); err != nil {
-		log.Fatalf("failed to start HTTP server: %s", err.Error())
+		fatal("failed to start HTTP server", "error", err)
+	}
 
+	// Peers discover each other over HTTP, so bootstrap once it is serving.
+	if peers != nil {
+		go func() {
+			if err := bootstrap(store, peers); err != nil {
+				fatal("failed to bootstrap cluster", "error", err)
+			}
+		}()
 	}
 
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Interrupt)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
 	<-terminate
+	if leaveOnTerminate {
+		if err := leave(store, nodeID); err != nil {
+			slog.Error("failed to leave cluster", "error", err)
+		}
+	}
 	if err := store.Close(); err != nil {
-		log.Printf("failed to close store: %s", err.Error())
+		slog.Error("failed to close store", "error", err)
+	}
+	slog.Info("duck-db server stopped")
+}
+
+// joinCluster joins the cluster through the first of addrs that accepts the
+// join, trying each address up to attempts times with exponential backoff.
+func joinCluster(addrs []string, attempts int, interval time.Duration, raftAddr, nodeID string, meta store.NodeMeta) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		for _, addr := range addrs {
+			if err = join(addr, raftAddr, nodeID, meta); err == nil {
+				slog.Info("joined cluster", "through", addr)
+				return nil
+			}
+			slog.Warn("failed to join cluster", "through", addr, "error", err)
+		}
+		if i < attempts-1 {
+			slog.Info("retrying join", "in", interval)
+			time.Sleep(interval)
+			interval = min(2*interval, maxJoinInterval)
+		}
 	}
-	log.Println("duck-db server stopped")
+	return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
 }
 
-func join(leaderAddr, raftAddr, serverID string) error {
-	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": serverID})
+// leave removes this node from the cluster, handing leadership to another
+// voter first if it is the leader.
+func leave(s store.Store, nodeID string) error {
+	if err := s.TransferLeadership(""); err == nil {
+		slog.Info("transferred leadership before leaving")
+	} else if !errors.Is(err, store.ErrNotLeader) {
+		slog.Warn("failed to transfer leadership", "error", err)
+	}
+
+	b, err := json.Marshal(map[string]string{"id": nodeID})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: leaveTimeout}
+	deadline := time.Now().Add(leaveTimeout)
+	for {
+		leader, err := s.WaitForLeader(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(fmt.Sprintf("http://%s/remove", leader), "application/json", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				slog.Info("left cluster")
+				return nil
+			}
+			err = fmt.Errorf("remove request failed: %s", resp.Status)
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		slog.Warn("failed to leave cluster, retrying", "error", err)
+		time.Sleep(bootstrapInterval)
+	}
+}
+
+func join(leaderAddr, raftAddr, nodeID string, meta store.NodeMeta) error {
+	role := httpd.RoleVoter
+	if nonvoter {
+		role = httpd.RoleNonvoter
+	}
+	b, err := json.Marshal(httpd.JoinRequest{
+		ID:            nodeID,
+		Addr:          raftAddr,
+		Role:          role,
+		HTTPAddr:      meta.HTTPAddr,
+		AdvertiseAddr: meta.AdvertiseAddr,
+		Version:       meta.Version,
+		Tags:          meta.Tags,
+	})
 	if err != nil {
-		log.Println("Error:", err)
 		return err
 	}
 	resp, err := http.Post(fmt.Sprintf("http://%s/join", leaderAddr), "application-type/json", bytes.NewReader(b))
 	if err != nil {
-		log.Println("Error:", err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("join request failed: %s", resp.Status)
+	}
 	return nil
 }
+
+// bootstrap waits until every peer is reachable and bootstraps a cluster of
+// all of them. Every node computes the same configuration, so it is safe to
+// run on all of them. If a peer is part of a cluster already, the node joins
+// it instead.
+func bootstrap(s store.Store, peers []string) error {
+	client := &http.Client{Timeout: bootstrapInterval}
+	for {
+		if ok, err := s.Bootstrapped(); err != nil {
+			return err
+		} else if ok {
+			slog.Info("node is part of a cluster, skipping bootstrap")
+			return nil
+		}
+
+		self := s.LocalNode()
+		nodes := map[string]store.Node{self.ID: self}
+		var clusters []string
+		reached := 0
+		for _, addr := range peers {
+			info, err := bootstrapInfo(client, addr)
+			if err != nil {
+				slog.Info("bootstrap peer not reachable", "peer", addr, "error", err)
+				continue
+			}
+			reached++
+			if info.Bootstrapped {
+				clusters = append(clusters, addr)
+				continue
+			}
+			if n, ok := nodes[info.Node.ID]; ok && n.RaftAddr != info.Node.RaftAddr {
+				return fmt.Errorf("node ID %s is used by %s and %s", n.ID, n.RaftAddr, info.Node.RaftAddr)
+			}
+			nodes[info.Node.ID] = info.Node
+		}
+
+		// A cluster has formed without this node, join it through any peer
+		// that accepts the join.
+		for _, addr := range clusters {
+			if err := join(addr, self.RaftAddr, self.ID, self.Meta); err != nil {
+				slog.Warn("failed to join cluster", "through", addr, "error", err)
+				continue
+			}
+			return nil
+		}
+
+		if reached == len(peers) {
+			var list []store.Node
+			for _, n := range nodes {
+				list = append(list, n)
+			}
+			return s.Bootstrap(list)
+		}
+		slog.Info("waiting for bootstrap nodes", "reached", reached, "expect", len(peers))
+		time.Sleep(bootstrapInterval)
+	}
+}
+
+// bootstrapInfo fetches the bootstrap information of the node at addr.
+func bootstrapInfo(client *http.Client, addr string) (*httpd.BootstrapInfo, error) {
+	resp, err := client.Get(fmt.Sprintf("http://%s/cluster/bootstrap", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var info httpd.BootstrapInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// parseTags parses a comma-separated list of key=value pairs.
+func parseTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", kv)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// newLogger returns a logger writing to stderr at the given level and in the
+// given format.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
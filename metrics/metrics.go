@@ -0,0 +1,119 @@
+// Package metrics defines the Prometheus metrics of the service and collects
+// the go-metrics emitted by hashicorp/raft into the same registry.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	gometricsprom "github.com/armon/go-metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric name.
+const namespace = "duckdb"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by endpoint, method and status code.",
+	}, []string{"endpoint", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by endpoint, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method", "code"})
+
+	// ExecuteDuration is the latency of writes through the store, by
+	// "execute" or "batch", including replication.
+	ExecuteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_execute_duration_seconds",
+		Help:      "Latency of writes through Raft, by execute or batch.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	// QueryDuration is the latency of reads by consistency level.
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_query_duration_seconds",
+		Help:      "Latency of reads by consistency level.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"level"})
+
+	// RaftApplyDuration is how long the leader takes to commit and apply a
+	// log entry.
+	RaftApplyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "raft_apply_duration_seconds",
+		Help:      "Time to commit and apply a Raft log entry on the leader.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// LeaderChanges counts the times this node gained or lost leadership.
+	LeaderChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "raft_leader_changes_total",
+		Help:      "Times this node became or stopped being the leader.",
+	})
+
+	// SnapshotDuration is the time to take and persist a snapshot.
+	SnapshotDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_duration_seconds",
+		Help:      "Time to take and persist a snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	// SnapshotSize is the size of the last persisted snapshot.
+	SnapshotSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_size_bytes",
+		Help:      "Compressed size of the last persisted snapshot.",
+	})
+)
+
+// Init routes the go-metrics emitted by hashicorp/raft to Prometheus.
+func Init() error {
+	sink, err := gometricsprom.NewPrometheusSink()
+	if err != nil {
+		return err
+	}
+	conf := gometrics.DefaultConfig(namespace)
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false // The Prometheus Go collector has them.
+	_, err = gometrics.NewGlobal(conf, sink)
+	return err
+}
+
+// ObserveRequest records an HTTP request. Methods other than the ones the
+// service serves are recorded as "other", so clients can't create labels.
+func ObserveRequest(endpoint, method string, code int, d time.Duration) {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodHead:
+	default:
+		method = "other"
+	}
+	c := strconv.Itoa(code)
+	httpRequests.WithLabelValues(endpoint, method, c).Inc()
+	httpRequestDuration.WithLabelValues(endpoint, method, c).Observe(d.Seconds())
+}
+
+// Register registers c with the default registry, replacing a collector of
+// the same metrics registered earlier.
+func Register(c prometheus.Collector) {
+	prometheus.Unregister(c)
+	prometheus.MustRegister(c)
+}
+
+// Handler serves the metrics in Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// How often the leader looks for dead nodes.
+const reconcileInterval = 5 * time.Second
+
+// DeadNodeAction is what the leader does to a node that has been unreachable
+// for longer than DeadNodeTimeout.
+type DeadNodeAction string
+
+const (
+	// DeadNodeRemove removes the node from the cluster, as Remove does.
+	DeadNodeRemove DeadNodeAction = "remove"
+	// DeadNodeDemote turns a voter into a non-voter, so it no longer counts
+	// towards quorum but can catch up and be promoted again when it returns.
+	DeadNodeDemote DeadNodeAction = "demote"
+)
+
+// heartbeatFailure is the last failed heartbeat seen for a follower.
+type heartbeatFailure struct {
+	lastContact time.Time // When the follower last answered.
+	seen        time.Time // When the failure was observed.
+}
+
+// failureTTL is how long a failed heartbeat counts without being seen again.
+// Observations are dropped when the channel is full, so the one telling that
+// a follower recovered may be missed. While a follower keeps failing, the
+// leader retries at least every HeartbeatTimeout/2, and each attempt takes at
+// most transportTimeout, so a failure that is not seen again for longer is
+// forgotten.
+func (ds *DistributedStore) failureTTL() time.Duration {
+	return transportTimeout + 3*ds.raft.ReloadableConfig().HeartbeatTimeout
+}
+
+// reconcileDeadNodes tracks the heartbeats of the followers and, while this
+// node is the leader, periodically applies DeadNodeAction to the nodes that
+// have been unreachable for longer than DeadNodeTimeout. It returns when the
+// store is closed.
+func (ds *DistributedStore) reconcileDeadNodes() {
+	defer ds.wg.Done()
+
+	ch := make(chan raft.Observation, 16)
+	observer := raft.NewObserver(ch, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation:
+			return true
+		}
+		return false
+	})
+	ds.raft.RegisterObserver(observer)
+	defer ds.raft.DeregisterObserver(observer)
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case o := <-ch:
+			ds.failedMu.Lock()
+			switch d := o.Data.(type) {
+			case raft.FailedHeartbeatObservation:
+				if ds.failed == nil {
+					ds.failed = make(map[raft.ServerID]heartbeatFailure)
+				}
+				ds.failed[d.PeerID] = heartbeatFailure{lastContact: d.LastContact, seen: time.Now()}
+			case raft.ResumedHeartbeatObservation:
+				delete(ds.failed, d.PeerID)
+			}
+			ds.failedMu.Unlock()
+		case <-ticker.C:
+			if ds.raft.State() == raft.Leader {
+				ds.handleDeadNodes()
+			}
+		case <-ds.shutdownCh:
+			return
+		}
+	}
+}
+
+// handleDeadNodes applies DeadNodeAction to every dead node, as long as the
+// cluster keeps enough voters to reach quorum afterwards.
+func (ds *DistributedStore) handleDeadNodes() {
+	f := ds.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		ds.logger.Error("failed to get raft configuration", "error", err)
+		return
+	}
+
+	// The last contact of the nodes still failing heartbeats.
+	ttl := ds.failureTTL()
+	ds.failedMu.Lock()
+	failed := make(map[raft.ServerID]time.Time, len(ds.failed))
+	for id, f := range ds.failed {
+		if time.Since(f.seen) > ttl {
+			delete(ds.failed, id)
+			continue
+		}
+		failed[id] = f.lastContact
+	}
+	ds.failedMu.Unlock()
+
+	voters, healthy := 0, 0
+	for _, srv := range f.Configuration().Servers {
+		if srv.Suffrage != raft.Voter {
+			continue
+		}
+		voters++
+		if _, ok := failed[srv.ID]; !ok {
+			healthy++
+		}
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		last, ok := failed[srv.ID]
+		if !ok || srv.ID == raft.ServerID(ds.serverID) || time.Since(last) < ds.DeadNodeTimeout {
+			continue
+		}
+		if srv.Suffrage == raft.Voter {
+			// The remaining voters must still be a quorum of the current
+			// configuration, and the healthy ones a quorum of the new one.
+			if voters-1 < quorum(voters) || healthy < quorum(voters-1) {
+				ds.logger.Warn("dead node kept, removing it would leave too few voters",
+					"node", srv.ID, "last_contact", last)
+				continue
+			}
+		} else if ds.DeadNodeAction == DeadNodeDemote {
+			continue
+		}
+
+		ds.logger.Warn("handling dead node", "node", srv.ID, "last_contact", last, "action", ds.DeadNodeAction)
+		var err error
+		if ds.DeadNodeAction == DeadNodeDemote {
+			err = ds.raft.DemoteVoter(srv.ID, 0, 0).Error()
+		} else {
+			err = ds.Remove(string(srv.ID))
+		}
+		if err != nil {
+			ds.logger.Error("failed to handle dead node", "node", srv.ID, "action", ds.DeadNodeAction, "error", err)
+			return
+		}
+		if srv.Suffrage == raft.Voter {
+			voters--
+		}
+		if ds.DeadNodeAction == DeadNodeRemove {
+			ds.failedMu.Lock()
+			delete(ds.failed, srv.ID)
+			ds.failedMu.Unlock()
+		}
+	}
+}
+
+// resetFailed forgets the heartbeat failures seen in an earlier term.
+func (ds *DistributedStore) resetFailed() {
+	ds.failedMu.Lock()
+	ds.failed = nil
+	ds.failedMu.Unlock()
+}
+
+// quorum returns the number of votes needed for a majority of n voters.
+func quorum(n int) int {
+	return n/2 + 1
+}
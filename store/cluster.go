@@ -0,0 +1,435 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NamanMahor/duckdb-service/metrics"
+	"github.com/hashicorp/raft"
+)
+
+// Metadata keys of nodes are nodeKeyPrefix followed by the node ID.
+const nodeKeyPrefix = "node/"
+
+// NodeMeta is the metadata of a node, replicated through the Raft log so that
+// every node knows how to reach the others over HTTP.
+type NodeMeta struct {
+	HTTPAddr      string            `json:"http_addr"`
+	AdvertiseAddr string            `json:"advertise_addr,omitempty"`
+	Version       string            `json:"version,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// Addr returns the HTTP address clients should use to reach the node.
+func (m NodeMeta) Addr() string {
+	if m.AdvertiseAddr != "" {
+		return m.AdvertiseAddr
+	}
+	return m.HTTPAddr
+}
+
+func (m NodeMeta) equal(o NodeMeta) bool {
+	return m.HTTPAddr == o.HTTPAddr && m.AdvertiseAddr == o.AdvertiseAddr &&
+		m.Version == o.Version && maps.Equal(m.Tags, o.Tags)
+}
+
+// Node is a member of the Raft configuration.
+type Node struct {
+	ID       string   `json:"id"`
+	RaftAddr string   `json:"raft_addr"`
+	Suffrage string   `json:"suffrage,omitempty"`
+	Leader   bool     `json:"leader"`
+	Meta     NodeMeta `json:"meta"`
+}
+
+// SetNodeMeta replicates the metadata of the node with the given ID. It must
+// be called on the leader.
+func (ds *DistributedStore) SetNodeMeta(nodeID string, meta NodeMeta) error {
+	if nodeID == "" {
+		return errors.New("node ID is required")
+	}
+	if meta.HTTPAddr == "" {
+		return errors.New("node HTTP address is required")
+	}
+	if current, ok := ds.nodeMeta(nodeID); ok && current.equal(meta) {
+		return nil
+	}
+	r, _, err := ds.apply(context.Background(), &Command{Type: commandSetNode, NodeID: nodeID, Node: &meta})
+	if err != nil {
+		return err
+	}
+	return r.error
+}
+
+// Remove removes the node with the given ID from the Raft configuration and
+// deletes its metadata. It must be called on the leader.
+func (ds *DistributedStore) Remove(nodeID string) error {
+	ds.logger.Info("removing node", "node", nodeID)
+	if ds.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	f := ds.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	member := false
+	for _, srv := range f.Configuration().Servers {
+		if srv.ID == raft.ServerID(nodeID) {
+			member = true
+			break
+		}
+	}
+	_, hasMeta := ds.nodeMeta(nodeID)
+	if !member && !hasMeta {
+		return ErrNodeNotFound
+	}
+
+	if member {
+		if err := ds.raft.RemoveServer(raft.ServerID(nodeID), 0, 0).Error(); err != nil {
+			if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+				return ErrNotLeader
+			}
+			return err
+		}
+	}
+	if hasMeta {
+		r, _, err := ds.apply(context.Background(), &Command{Type: commandRemoveNode, NodeID: nodeID})
+		if err != nil {
+			return err
+		}
+		if r.error != nil {
+			return r.error
+		}
+	}
+	ds.logger.Info("node removed", "node", nodeID)
+	return nil
+}
+
+// SetVoter promotes the non-voter with the given ID to a voter, or demotes the
+// voter to a non-voter. It must be called on the leader, and the leader
+// cannot demote itself.
+func (ds *DistributedStore) SetVoter(nodeID string, voter bool) error {
+	if ds.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	f := ds.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	var srv *raft.Server
+	for _, s := range f.Configuration().Servers {
+		if s.ID == raft.ServerID(nodeID) {
+			srv = &s
+			break
+		}
+	}
+	if srv == nil {
+		return ErrNodeNotFound
+	}
+	if (srv.Suffrage == raft.Voter) == voter {
+		return nil
+	}
+
+	var err error
+	if voter {
+		ds.logger.Info("promoting node to voter", "node", nodeID)
+		err = ds.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error()
+	} else {
+		if nodeID == ds.serverID {
+			return errors.New("cannot demote the leader, transfer leadership first")
+		}
+		ds.logger.Info("demoting node to non-voter", "node", nodeID)
+		err = ds.raft.DemoteVoter(srv.ID, 0, 0).Error()
+	}
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return ErrNotLeader
+	}
+	return err
+}
+
+// TransferLeadership hands leadership to the voter with the given ID, or to
+// the most up to date voter if nodeID is empty. It must be called on the
+// leader, and returns once the leader has stepped down.
+func (ds *DistributedStore) TransferLeadership(nodeID string) error {
+	if ds.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	var f raft.Future
+	if nodeID == "" {
+		f = ds.raft.LeadershipTransfer()
+	} else {
+		cf := ds.raft.GetConfiguration()
+		if err := cf.Error(); err != nil {
+			return err
+		}
+		var target *raft.Server
+		for _, srv := range cf.Configuration().Servers {
+			if srv.ID == raft.ServerID(nodeID) {
+				target = &srv
+				break
+			}
+		}
+		if target == nil {
+			return ErrNodeNotFound
+		}
+		if target.Suffrage != raft.Voter {
+			return ErrNotVoter
+		}
+		if nodeID == ds.serverID {
+			return nil
+		}
+		f = ds.raft.LeadershipTransferToServer(target.ID, target.Address)
+	}
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return ErrNotLeader
+		}
+		return err
+	}
+	ds.logger.Info("leadership transferred", "target", nodeID)
+	return nil
+}
+
+// Nodes returns every node in the Raft configuration, sorted by ID.
+func (ds *DistributedStore) Nodes() ([]Node, error) {
+	f := ds.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	_, leaderID := ds.raft.LeaderWithID()
+
+	var nodes []Node
+	for _, srv := range f.Configuration().Servers {
+		meta, _ := ds.nodeMeta(string(srv.ID))
+		nodes = append(nodes, Node{
+			ID:       string(srv.ID),
+			RaftAddr: string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+			Leader:   srv.ID == leaderID,
+			Meta:     meta,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// LocalState is the replication state of a node. AppliedIndex and
+// CommitIndex count every log entry, including the barriers and
+// configuration changes the database never sees, so their difference is
+// what the node has yet to apply.
+type LocalState struct {
+	ID           string `json:"id"`
+	Leader       bool   `json:"leader"`
+	AppliedIndex uint64 `json:"applied_index"`
+	CommitIndex  uint64 `json:"commit_index"`
+	// LastContact is when a follower last heard from the leader. It is nil
+	// on the leader, and on a follower that has never heard from one.
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// LocalState returns the replication state of this node.
+func (ds *DistributedStore) LocalState() LocalState {
+	state := LocalState{
+		ID:           ds.serverID,
+		Leader:       ds.raft.State() == raft.Leader,
+		AppliedIndex: ds.raft.AppliedIndex(),
+		CommitIndex:  ds.raft.CommitIndex(),
+	}
+	if t := ds.raft.LastContact(); !state.Leader && !t.IsZero() {
+		state.LastContact = &t
+	}
+	return state
+}
+
+// LocalNode returns this node as it appears in the Raft configuration.
+// Suffrage is empty while the node is not part of the configuration, before
+// it bootstrapped or joined a cluster.
+func (ds *DistributedStore) LocalNode() Node {
+	n := Node{
+		ID:       ds.serverID,
+		RaftAddr: string(ds.raftAddr),
+		Meta:     ds.Meta,
+	}
+	f := ds.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		ds.logger.Warn("failed to get raft configuration", "error", err)
+		return n
+	}
+	for _, srv := range f.Configuration().Servers {
+		if srv.ID == raft.ServerID(ds.serverID) {
+			n.Suffrage = srv.Suffrage.String()
+			_, leaderID := ds.raft.LeaderWithID()
+			n.Leader = srv.ID == leaderID
+		}
+	}
+	return n
+}
+
+// Bootstrapped reports whether this node has a Raft configuration, either
+// because it bootstrapped or joined a cluster, or because it has state from
+// an earlier run.
+func (ds *DistributedStore) Bootstrapped() (bool, error) {
+	f := ds.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return false, err
+	}
+	return len(f.Configuration().Servers) > 0, nil
+}
+
+// Bootstrap bootstraps a new cluster of voters made of the given nodes. Every
+// node must be given the same nodes, in any order, so that they all start
+// with the same configuration. Their metadata is registered by whichever
+// becomes the first leader. Bootstrapping a node that is part of a cluster
+// already does nothing.
+func (ds *DistributedStore) Bootstrap(nodes []Node) error {
+	var servers []raft.Server
+	pending := make(map[string]NodeMeta)
+	for _, n := range nodes {
+		servers = append(servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(n.ID),
+			Address:  raft.ServerAddress(n.RaftAddr),
+		})
+		pending[n.ID] = n.Meta
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+
+	ds.nodesMu.Lock()
+	ds.pendingMeta = pending
+	ds.nodesMu.Unlock()
+
+	err := ds.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if errors.Is(err, raft.ErrCantBootstrap) {
+		ds.logger.Info("node already has state, not bootstrapping")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ds.logger.Info("bootstrapped cluster", "nodes", len(servers))
+	return nil
+}
+
+// applySetNode stores the metadata of a node in the database and the cache.
+// A nil meta removes the node.
+func (ds *DistributedStore) applySetNode(nodeID string, meta *NodeMeta, index uint64) error {
+	var value string
+	if meta != nil {
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		value = string(b)
+	}
+	if err := ds.db.SetMetadata(nodeKeyPrefix+nodeID, value, index); err != nil {
+		return err
+	}
+
+	ds.nodesMu.Lock()
+	defer ds.nodesMu.Unlock()
+	if meta == nil {
+		delete(ds.nodes, nodeID)
+	} else {
+		ds.nodes[nodeID] = *meta
+	}
+	return nil
+}
+
+// loadNodes reads the metadata of the nodes from the database into the cache.
+func (ds *DistributedStore) loadNodes() error {
+	ds.dbMu.RLock()
+	md, err := ds.db.Metadata()
+	ds.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[string]NodeMeta)
+	for k, v := range md {
+		id, ok := strings.CutPrefix(k, nodeKeyPrefix)
+		if !ok {
+			continue
+		}
+		var meta NodeMeta
+		if err := json.Unmarshal([]byte(v), &meta); err != nil {
+			ds.logger.Warn("ignoring invalid node metadata", "node", id, "error", err)
+			continue
+		}
+		nodes[id] = meta
+	}
+	ds.setNodes(nodes)
+	return nil
+}
+
+func (ds *DistributedStore) setNodes(nodes map[string]NodeMeta) {
+	if nodes == nil {
+		nodes = make(map[string]NodeMeta)
+	}
+	ds.nodesMu.Lock()
+	ds.nodes = nodes
+	ds.nodesMu.Unlock()
+}
+
+func (ds *DistributedStore) nodeMeta(nodeID string) (NodeMeta, bool) {
+	ds.nodesMu.RLock()
+	defer ds.nodesMu.RUnlock()
+	meta, ok := ds.nodes[nodeID]
+	return meta, ok
+}
+
+// nodeMetas returns a copy of the metadata of every node.
+func (ds *DistributedStore) nodeMetas() map[string]NodeMeta {
+	ds.nodesMu.RLock()
+	defer ds.nodesMu.RUnlock()
+	return maps.Clone(ds.nodes)
+}
+
+// monitorLeadership registers the metadata of this node whenever it becomes
+// the leader, so that a node bootstrapped on its own, or restarted with a new
+// address, is reachable by the others.
+func (ds *DistributedStore) monitorLeadership() {
+	for leader := range ds.raft.LeaderCh() {
+		metrics.LeaderChanges.Inc()
+		ds.resetFailed()
+		if !leader {
+			continue
+		}
+		// Make sure the metadata of earlier terms has been applied first.
+		if err := ds.raft.Barrier(raftTimeout).Error(); err != nil {
+			ds.logger.Error("failed to wait for log to be applied", "error", err)
+			continue
+		}
+		if ds.Meta.HTTPAddr != "" {
+			if err := ds.SetNodeMeta(ds.serverID, ds.Meta); err != nil {
+				ds.logger.Error("failed to register node metadata", "error", err)
+			}
+		}
+		ds.registerPendingMeta()
+	}
+}
+
+// registerPendingMeta registers the metadata of the bootstrap peers that have
+// none yet.
+func (ds *DistributedStore) registerPendingMeta() {
+	ds.nodesMu.Lock()
+	pending := ds.pendingMeta
+	ds.pendingMeta = nil
+	ds.nodesMu.Unlock()
+
+	for id, meta := range pending {
+		if _, ok := ds.nodeMeta(id); ok || id == ds.serverID || meta.HTTPAddr == "" {
+			continue
+		}
+		if err := ds.SetNodeMeta(id, meta); err != nil {
+			ds.logger.Error("failed to register node metadata", "node", id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// levelTrace is the slog level of hclog's trace messages.
+const levelTrace = slog.LevelDebug - 4
+
+// hclogAdapter routes the hclog output of hashicorp/raft to a slog.Logger.
+// The level is taken from the slog handler, so SetLevel has no effect.
+type hclogAdapter struct {
+	base   *slog.Logger // Logger without the name and implied args.
+	logger *slog.Logger // base with the name and implied args.
+	name   string
+	args   []interface{}
+}
+
+func newHCLogger(base *slog.Logger, name string, args []interface{}) hclog.Logger {
+	logger := base.With(append([]interface{}{"logger", name}, hclogArgs(args)...)...)
+	return &hclogAdapter{base: base, logger: logger, name: name, args: args}
+}
+
+func (a *hclogAdapter) Log(level hclog.Level, msg string, args ...interface{}) {
+	a.logger.Log(context.Background(), slogLevel(level), msg, hclogArgs(args)...)
+}
+
+// hclogArgs formats the values that hclog renders specially, which slog would
+// otherwise print as their raw structure.
+func hclogArgs(args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, v := range args {
+		switch v := v.(type) {
+		case hclog.Format:
+			if len(v) > 0 {
+				if f, ok := v[0].(string); ok {
+					out[i] = fmt.Sprintf(f, v[1:]...)
+					continue
+				}
+			}
+			out[i] = fmt.Sprint(v...)
+		case error:
+			out[i] = v
+		case fmt.Stringer:
+			out[i] = v.String()
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+func (a *hclogAdapter) Trace(msg string, args ...interface{}) { a.Log(hclog.Trace, msg, args...) }
+func (a *hclogAdapter) Debug(msg string, args ...interface{}) { a.Log(hclog.Debug, msg, args...) }
+func (a *hclogAdapter) Info(msg string, args ...interface{})  { a.Log(hclog.Info, msg, args...) }
+func (a *hclogAdapter) Warn(msg string, args ...interface{})  { a.Log(hclog.Warn, msg, args...) }
+func (a *hclogAdapter) Error(msg string, args ...interface{}) { a.Log(hclog.Error, msg, args...) }
+
+func (a *hclogAdapter) IsTrace() bool { return a.enabled(hclog.Trace) }
+func (a *hclogAdapter) IsDebug() bool { return a.enabled(hclog.Debug) }
+func (a *hclogAdapter) IsInfo() bool  { return a.enabled(hclog.Info) }
+func (a *hclogAdapter) IsWarn() bool  { return a.enabled(hclog.Warn) }
+func (a *hclogAdapter) IsError() bool { return a.enabled(hclog.Error) }
+
+func (a *hclogAdapter) enabled(level hclog.Level) bool {
+	return a.logger.Enabled(context.Background(), slogLevel(level))
+}
+
+func (a *hclogAdapter) ImpliedArgs() []interface{} { return a.args }
+
+func (a *hclogAdapter) With(args ...interface{}) hclog.Logger {
+	return newHCLogger(a.base, a.name, append(append([]interface{}{}, a.args...), args...))
+}
+
+func (a *hclogAdapter) Name() string { return a.name }
+
+func (a *hclogAdapter) Named(name string) hclog.Logger {
+	if a.name != "" {
+		name = a.name + "." + name
+	}
+	return a.ResetNamed(name)
+}
+
+func (a *hclogAdapter) ResetNamed(name string) hclog.Logger {
+	return newHCLogger(a.base, name, a.args)
+}
+
+func (a *hclogAdapter) SetLevel(hclog.Level) {}
+
+func (a *hclogAdapter) GetLevel() hclog.Level {
+	for _, l := range []hclog.Level{hclog.Trace, hclog.Debug, hclog.Info, hclog.Warn, hclog.Error} {
+		if a.enabled(l) {
+			return l
+		}
+	}
+	return hclog.Off
+}
+
+func (a *hclogAdapter) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
+	level := hclog.Info
+	if opts != nil && opts.ForceLevel != hclog.NoLevel {
+		level = opts.ForceLevel
+	}
+	return slog.NewLogLogger(a.logger.Handler(), slogLevel(level))
+}
+
+func (a *hclogAdapter) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
+	return a.StandardLogger(opts).Writer()
+}
+
+func slogLevel(level hclog.Level) slog.Level {
+	switch level {
+	case hclog.Trace:
+		return levelTrace
+	case hclog.Debug:
+		return slog.LevelDebug
+	case hclog.Warn:
+		return slog.LevelWarn
+	case hclog.Error:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+
+	sql "github.com/NamanMahor/duckdb-service/db"
+)
+
+// readWindow is how many rows a read buffers ahead of its client. Once the
+// window is full, the read waits for the client without holding up a
+// restore, which interrupts it.
+const readWindow = 256
+
+// rowEvent is the columns or a row of a query, handed over by a rowPipe.
+type rowEvent struct {
+	header  bool
+	columns []string
+	types   []string
+	values  []interface{}
+}
+
+// rowPipe hands the result of a query over to the goroutine writing it to
+// the client, so that the database is not held while the client is slow.
+type rowPipe struct {
+	ctx context.Context
+	ch  chan<- rowEvent
+}
+
+func (p *rowPipe) WriteColumns(columns, types []string) error {
+	return p.send(rowEvent{header: true, columns: columns, types: types})
+}
+
+func (p *rowPipe) WriteRow(values []interface{}) error {
+	return p.send(rowEvent{values: values})
+}
+
+func (p *rowPipe) send(e rowEvent) error {
+	select {
+	case p.ch <- e:
+		return nil
+	case <-p.ctx.Done():
+		return context.Cause(p.ctx)
+	}
+}
+
+// readRows runs the query with the database held, and hands its rows to w.
+// A restore interrupts it with ErrRestoring.
+func (ds *DistributedStore) readRows(ctx context.Context, cancel context.CancelCauseFunc, w sql.RowWriter, query string, args []interface{}) error {
+	ds.dbMu.RLock()
+	defer ds.dbMu.RUnlock()
+
+	id := ds.startRead(cancel)
+	defer ds.endRead(id)
+	err := ds.db.QueryRows(ctx, w, query, args...)
+	if err != nil && context.Cause(ctx) == ErrRestoring {
+		return ErrRestoring
+	}
+	return err
+}
+
+// startRead registers a read holding the database, so that a restore can
+// interrupt it. A read that starts while a restore waits for the database is
+// interrupted right away.
+func (ds *DistributedStore) startRead(cancel context.CancelCauseFunc) uint64 {
+	ds.readsMu.Lock()
+	defer ds.readsMu.Unlock()
+
+	if ds.restoring {
+		cancel(ErrRestoring)
+	}
+	ds.nextRead++
+	if ds.reads == nil {
+		ds.reads = make(map[uint64]context.CancelCauseFunc)
+	}
+	ds.reads[ds.nextRead] = cancel
+	return ds.nextRead
+}
+
+func (ds *DistributedStore) endRead(id uint64) {
+	ds.readsMu.Lock()
+	delete(ds.reads, id)
+	ds.readsMu.Unlock()
+}
+
+// interruptReads interrupts the reads holding the database, and those that
+// start until resumeReads is called, so that a restore can take it.
+func (ds *DistributedStore) interruptReads() {
+	ds.readsMu.Lock()
+	defer ds.readsMu.Unlock()
+
+	ds.restoring = true
+	for _, cancel := range ds.reads {
+		cancel(ErrRestoring)
+	}
+}
+
+func (ds *DistributedStore) resumeReads() {
+	ds.readsMu.Lock()
+	ds.restoring = false
+	ds.readsMu.Unlock()
+}
@@ -2,53 +2,261 @@ package store
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	sql "github.com/NamanMahor/duckdb-service/db"
+	"github.com/NamanMahor/duckdb-service/metrics"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
+	transportTimeout    = 10 * time.Second // I/O timeout of the Raft transport.
+
+	// How often a read waiting for a minimum index checks the applied index.
+	appliedIndexPollInterval = 10 * time.Millisecond
+
+	// How often WaitForLeader checks for a leader.
+	leaderPollInterval = 50 * time.Millisecond
+
+	// Files left over by a snapshot or a restore.
+	snapshotDirPattern = "duckdb_snapshot_*"
+	restoreDirPattern  = "duckdb_restore_*"
+	backupSuffix       = ".old"
+	walSuffix          = ".wal"
+
+	// manifestFile is the first entry of a snapshot archive.
+	manifestFile    = "MANIFEST.json"
+	manifestVersion = 1
+)
+
+// SnapshotFormat selects how the database is stored in snapshots.
+type SnapshotFormat string
+
+const (
+	// SnapshotFile checkpoints the database and copies the DuckDB file as is.
+	// It is fast and keeps every type, constraint and sequence.
+	SnapshotFile SnapshotFormat = "file"
+	// SnapshotParquet exports the database with EXPORT DATABASE in Parquet
+	// format, which is slower but portable across DuckDB versions.
+	SnapshotParquet SnapshotFormat = "parquet"
 )
 
+// zstdMagic starts every zstd frame, and tells compressed snapshots apart
+// from the plain tar archives written by earlier versions.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
 var (
 	ErrNotLeader = errors.New("not leader")
+
+	// ErrNoLeader is returned when the cluster has no known leader.
+	ErrNoLeader = errors.New("no leader")
+
+	// ErrStaleRead is returned when a follower is further behind the leader
+	// than a read allows.
+	ErrStaleRead = errors.New("stale read")
+
+	// ErrNodeNotFound is returned when removing a node that is not a member
+	// of the cluster.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrNotVoter is returned when leadership is transferred to a non-voter.
+	ErrNotVoter = errors.New("node is not a voter")
+
+	// ErrIndexTimeout is returned when a read's minimum index was not applied in time.
+	ErrIndexTimeout = errors.New("timeout waiting for index to be applied")
+
+	// ErrRestoring is returned by reads interrupted by a snapshot restore.
+	ErrRestoring = errors.New("read interrupted by a snapshot restore")
 )
 
+// ConsistencyLevel is the freshness guarantee of a read.
+type ConsistencyLevel int
+
+const (
+	// None reads the local database, which may be arbitrarily stale.
+	None ConsistencyLevel = iota
+	// Weak requires the node to believe it is the leader. A deposed leader
+	// that has not noticed yet may still serve stale data.
+	Weak
+	// Strong requires the node to confirm its leadership with a quorum and
+	// apply every committed entry before reading, giving linearizable reads.
+	Strong
+)
+
+func (l ConsistencyLevel) String() string {
+	switch l {
+	case Weak:
+		return "weak"
+	case Strong:
+		return "strong"
+	default:
+		return "none"
+	}
+}
+
+// ParseConsistencyLevel parses "none", "weak" or "strong". An empty string is None.
+func ParseConsistencyLevel(s string) (ConsistencyLevel, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return None, nil
+	case "weak":
+		return Weak, nil
+	case "strong":
+		return Strong, nil
+	default:
+		return None, fmt.Errorf("invalid consistency level %q", s)
+	}
+}
+
 type Store interface {
-	Execute(query string) (*sql.ExecuteResult, error)
+	// Execute executes the statement through Raft. It also returns the index
+	// of the log entry, which can be passed to Query as QueryOptions.MinIndex
+	// to read your own writes on any node. ctx bounds the wait for the entry
+	// to be committed; once replicated, the entry is applied regardless.
+	Execute(ctx context.Context, stmt sql.Statement) (*sql.ExecuteResult, uint64, error)
+
+	// ExecuteBatch executes the statements atomically, as one Raft log entry
+	// applied in one transaction.
+	ExecuteBatch(ctx context.Context, stmts []sql.Statement) ([]*sql.ExecuteResult, uint64, error)
+
+	// Query reads the local database. Weak and Strong reads return ErrNotLeader
+	// when the node is not the leader. Cancelling ctx interrupts the query,
+	// and so does a snapshot restore, with ErrRestoring.
+	Query(ctx context.Context, stmt sql.Statement, opts QueryOptions) (*sql.QueryResult, error)
+
+	// QueryRows is Query that hands the rows to w as they are read instead
+	// of returning them. It fails like Query before w sees any column.
+	QueryRows(ctx context.Context, stmt sql.Statement, opts QueryOptions, w sql.RowWriter) error
+
+	// Queries returns the statements executing on this node, including the
+	// writes being applied through Raft.
+	Queries() []sql.RunningQuery
+
+	// KillQuery interrupts a query executing on this node. It returns
+	// sql.ErrQueryNotFound for unknown IDs and sql.ErrNotKillable for writes.
+	KillQuery(id uint64) error
 
-	Query(query string) (*sql.QueryResult, error)
+	// Join adds the node to the cluster as a voter or a non-voter and
+	// records its metadata.
+	Join(nodeID string, addr string, voter bool, meta NodeMeta) error
 
-	Join(nodeID string, addr string) error
+	// SetVoter promotes a non-voter to a voter, or demotes a voter to a
+	// non-voter.
+	SetVoter(nodeID string, voter bool) error
 
-	Leader() string // http address of leader
+	// Remove removes the node from the cluster and deletes its metadata.
+	Remove(nodeID string) error
+
+	// TransferLeadership hands leadership to the given node, or to any
+	// other voter if nodeID is empty.
+	TransferLeadership(nodeID string) error
+
+	// Nodes returns every node in the Raft configuration with its metadata.
+	Nodes() ([]Node, error)
+
+	// LocalNode returns this node as it appears in the Raft configuration.
+	LocalNode() Node
+
+	// LocalState returns the replication state of this node.
+	LocalState() LocalState
+
+	// Bootstrapped reports whether this node is part of a cluster already.
+	Bootstrapped() (bool, error)
+
+	// Bootstrap bootstraps a new cluster made of the given nodes.
+	Bootstrap(nodes []Node) error
+
+	// Leader returns the HTTP address of the leader, or ErrNoLeader while
+	// there is none or its address is not known yet, such as during an
+	// election.
+	Leader() (string, error)
+
+	// WaitForLeader waits up to timeout for a leader to be known.
+	WaitForLeader(timeout time.Duration) (string, error)
 
 	Stats() (map[string]interface{}, error)
 }
 
+// QueryOptions control the freshness of a read.
+type QueryOptions struct {
+	Level ConsistencyLevel
+
+	// MinIndex makes the read wait, up to MinIndexTimeout, until the local
+	// FSM has applied at least this log index.
+	MinIndex        uint64
+	MinIndexTimeout time.Duration
+
+	// MaxStaleness and MaxLag bound how far behind the leader a follower may
+	// be to serve the read: by time since its last contact with the leader,
+	// and by the number of committed entries it has not applied yet. Reads
+	// beyond either bound fail with ErrStaleRead. Zero means no bound.
+	MaxStaleness time.Duration
+	MaxLag       uint64
+}
+
 // DistributedStore is a DuckDb database, where all changes are made via Raft consensus.
 type DistributedStore struct {
 	raftDir  string
 	raftBind string
-	raft     *raft.Raft // The consensus mechanism.
+	raftAddr raft.ServerAddress // Address other nodes reach this node's Raft at.
+	raft     *raft.Raft         // The consensus mechanism.
+
+	dbDir string       // Path to database dir
+	dbMu  sync.RWMutex // Held for writing while Restore replaces db.
+	db    *sql.DB      // The underlying duckdb.
+
+	readsMu   sync.Mutex
+	reads     map[uint64]context.CancelCauseFunc // Reads holding dbMu, by ID.
+	nextRead  uint64
+	restoring bool // Set while a restore waits for dbMu.
+
+	// SnapshotFormat is the format of new snapshots. Restore accepts both.
+	SnapshotFormat SnapshotFormat
 
-	dbDir string  // Path to database dir
-	db    *sql.DB // The underlying duckdb.
+	appliedIndex atomic.Uint64 // Index of the last log entry applied to db.
+	skipRestore  atomic.Bool   // Skip restoring the snapshot on startup, db already contains it.
 
-	logger *log.Logger
+	nodesMu     sync.RWMutex
+	nodes       map[string]NodeMeta // Replicated metadata of every node, by ID.
+	pendingMeta map[string]NodeMeta // Metadata of bootstrap peers, registered by the first leader.
+
+	serverID string
+	// Meta is the metadata of this node, registered with the cluster when
+	// the node joins or becomes the leader.
+	Meta NodeMeta
+
+	// DeadNodeTimeout is how long a node may be unreachable from the leader
+	// before the leader applies DeadNodeAction to it. Zero disables this.
+	DeadNodeTimeout time.Duration
+	DeadNodeAction  DeadNodeAction
+
+	failedMu sync.Mutex
+	failed   map[raft.ServerID]heartbeatFailure // Nodes failing heartbeats.
+
+	shutdownCh chan struct{} // Closed by Close to stop the background goroutines.
+	wg         sync.WaitGroup
+
+	logger *slog.Logger
 }
 
 func New(basePath, bind string) *DistributedStore {
@@ -59,59 +267,84 @@ func New(basePath, bind string) *DistributedStore {
 		raftDir:  raftDir,
 		raftBind: bind,
 		dbDir:    dbDir,
-		logger:   log.New(os.Stdout, "[DistributedStore] ", log.LstdFlags),
+
+		SnapshotFormat: SnapshotFile,
+		DeadNodeAction: DeadNodeRemove,
+
+		shutdownCh: make(chan struct{}),
+
+		logger: slog.Default().With("component", "store"),
 	}
 }
 
+// Open opens the database and starts Raft with serverID as the server ID. A
+// node whose Raft state was written by an earlier version, which used
+// "id|httpAddr" as the server ID, keeps using that ID; LocalNode returns the
+// ID in use.
 func (ds *DistributedStore) Open(enableSingle bool, serverID string) error {
-	// should be create from snapshot
-	if err := os.RemoveAll(ds.dbDir); err != nil && !os.IsNotExist(err) {
+	if err := os.MkdirAll(ds.raftDir, 0755); err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(ds.raftDir, 0755); err != nil {
-		return err
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(ds.raftDir, retainSnapshotCount, newHCLogger(ds.logger, "snapshot", nil))
+	if err != nil {
+		return fmt.Errorf("file snapshot store: %s", err)
+	}
+	var snapshotIndex uint64
+	metas, err := snapshots.List()
+	if err != nil {
+		return fmt.Errorf("list snapshots: %s", err)
+	}
+	if len(metas) > 0 {
+		snapshotIndex = ds.snapshotAppliedIndex(snapshots, metas[0])
 	}
 
-	if err := os.MkdirAll(ds.dbDir, 0755); err != nil {
-		return err
+	boltDB, err := raftboltdb.New(raftboltdb.Options{
+		Path: filepath.Join(ds.raftDir, "raft.db"),
+	})
+	if err != nil {
+		return fmt.Errorf("new bbolt store: %s", err)
 	}
 
-	ds.logger.Println("Opening Duckdb at", ds.dbDir)
-	db, err := sql.Open(ds.dbDir)
+	// Without Raft state the database can't be matched to the log.
+	hasState, err := raft.HasExistingState(boltDB, boltDB, snapshots)
 	if err != nil {
 		return err
 	}
-	ds.db = db
-	ds.logger.Println("Opened Duckdb at", ds.dbDir)
+	if hasState {
+		configuration, err := latestConfiguration(boltDB, metas)
+		if err != nil {
+			return fmt.Errorf("read raft configuration: %s", err)
+		}
+		if id, ok := legacyServerID(configuration, serverID); ok {
+			ds.logger.Warn("keeping server ID of an earlier version", "id", serverID, "server_id", id)
+			serverID = id
+		}
+	}
+	ds.serverID = serverID
+
+	if err := ds.openDB(hasState, snapshotIndex); err != nil {
+		return err
+	}
 
 	// Setup Raft configuration.
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(serverID)
+	config.Logger = newHCLogger(ds.logger, "raft", nil)
 
 	addr, err := net.ResolveTCPAddr("tcp", ds.raftBind)
 	if err != nil {
 		return err
 	}
-	transport, err := raft.NewTCPTransport(ds.raftBind, addr, 3, 10*time.Second, os.Stderr)
+	transport, err := raft.NewTCPTransportWithLogger(ds.raftBind, addr, 3, transportTimeout, newHCLogger(ds.logger, "raft-net", nil))
 	if err != nil {
 		return err
 	}
-
-	snapshots, err := raft.NewFileSnapshotStore(ds.raftDir, retainSnapshotCount, os.Stderr)
-	if err != nil {
-		return fmt.Errorf("file snapshot store: %s", err)
-	}
-
-	boltDB, err := raftboltdb.New(raftboltdb.Options{
-		Path: filepath.Join(ds.raftDir, "raft.db"),
-	})
-	if err != nil {
-		return fmt.Errorf("new bbolt store: %s", err)
-	}
+	ds.raftAddr = transport.LocalAddr()
 
 	// Instantiate the Raft systems.
 	ra, err := raft.NewRaft(config, ds, boltDB, boltDB, snapshots, transport)
+	ds.skipRestore.Store(false)
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
@@ -128,11 +361,171 @@ func (ds *DistributedStore) Open(enableSingle bool, serverID string) error {
 		ra.BootstrapCluster(configuration)
 	}
 
+	metrics.Register(&collector{ds: ds})
+	go ds.monitorLeadership()
+	if ds.DeadNodeTimeout > 0 {
+		ds.wg.Add(1)
+		go ds.reconcileDeadNodes()
+	}
+
 	return nil
 }
 
+// latestConfiguration returns the last Raft configuration in the log, or the
+// one of the latest snapshot if the log has none.
+func latestConfiguration(logs raft.LogStore, metas []*raft.SnapshotMeta) (raft.Configuration, error) {
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return raft.Configuration{}, err
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return raft.Configuration{}, err
+	}
+	for idx := last; idx >= first && idx > 0; idx-- {
+		var l raft.Log
+		if err := logs.GetLog(idx, &l); err != nil {
+			return raft.Configuration{}, err
+		}
+		if l.Type == raft.LogConfiguration {
+			return raft.DecodeConfiguration(l.Data), nil
+		}
+	}
+	if len(metas) > 0 {
+		return metas[0].Configuration, nil
+	}
+	return raft.Configuration{}, nil
+}
+
+// legacyServerID returns the server ID "id|httpAddr" that earlier versions
+// gave the node with the given ID, if configuration has one and does not
+// have id itself.
+func legacyServerID(configuration raft.Configuration, id string) (string, bool) {
+	var legacy string
+	for _, srv := range configuration.Servers {
+		switch {
+		case string(srv.ID) == id:
+			return "", false
+		case strings.HasPrefix(string(srv.ID), id+"|"):
+			legacy = string(srv.ID)
+		}
+	}
+	return legacy, legacy != ""
+}
+
+// snapshotAppliedIndex returns the applied index of the database in the
+// snapshot, which is behind the snapshot's own index when the last entries
+// before it were barriers or configuration changes. Snapshots taken before
+// the manifest recorded it fall back to the snapshot's index.
+func (ds *DistributedStore) snapshotAppliedIndex(snapshots raft.SnapshotStore, meta *raft.SnapshotMeta) uint64 {
+	_, rc, err := snapshots.Open(meta.ID)
+	if err != nil {
+		ds.logger.Warn("failed to open snapshot", "snapshot", meta.ID, "error", err)
+		return meta.Index
+	}
+	defer rc.Close()
+
+	manifest, err := readManifest(rc)
+	if err != nil {
+		ds.logger.Warn("failed to read snapshot manifest", "snapshot", meta.ID, "error", err)
+		return meta.Index
+	}
+	if manifest == nil || manifest.AppliedIndex == 0 {
+		return meta.Index
+	}
+	return manifest.AppliedIndex
+}
+
+// openDB opens the database left by a previous run if it is intact and not
+// older than the database in the latest snapshot, whose applied index is
+// snapshotIndex, so that only the log entries it has not applied yet are
+// replayed. Otherwise it starts from an empty database, which Raft rebuilds
+// from the snapshot and the log.
+func (ds *DistributedStore) openDB(reuse bool, snapshotIndex uint64) error {
+	if err := ds.cleanupStaging(); err != nil {
+		return err
+	}
+
+	_, err := os.Stat(filepath.Join(ds.dbDir, sql.FileName))
+	if err == nil && reuse {
+		db, err := sql.Open(ds.dbDir)
+		if err == nil {
+			appliedIndex, err := db.AppliedIndex()
+			switch {
+			case err != nil:
+				ds.logger.Warn("failed to read applied index, rebuilding database", "error", err)
+			case appliedIndex == 0 || appliedIndex < snapshotIndex:
+				ds.logger.Info("database is behind snapshot, rebuilding database", "applied_index", appliedIndex, "snapshot_index", snapshotIndex)
+			default:
+				ds.logger.Info("reusing database", "path", ds.dbDir, "applied_index", appliedIndex)
+				ds.db = db
+				ds.appliedIndex.Store(appliedIndex)
+				if err := ds.loadNodes(); err != nil {
+					return err
+				}
+				// The database already contains the latest snapshot.
+				ds.skipRestore.Store(snapshotIndex > 0)
+				return nil
+			}
+			db.Close()
+		} else {
+			ds.logger.Warn("failed to open existing database, rebuilding database", "error", err)
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.RemoveAll(ds.dbDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(ds.dbDir, 0755); err != nil {
+		return err
+	}
+
+	db, err := sql.Open(ds.dbDir)
+	if err != nil {
+		return err
+	}
+	ds.db = db
+	ds.appliedIndex.Store(0)
+	ds.setNodes(nil)
+	ds.logger.Info("opened new database", "path", ds.dbDir)
+	return nil
+}
+
+// cleanupStaging removes what a snapshot or a restore interrupted by a crash
+// left behind. If the crash happened between moving the live database aside
+// and moving the restored one in place, the old database is put back.
+func (ds *DistributedStore) cleanupStaging() error {
+	for _, pattern := range []string{snapshotDirPattern, restoreDirPattern} {
+		dirs, err := filepath.Glob(filepath.Join(filepath.Dir(ds.dbDir), pattern))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	dbPath := filepath.Join(ds.dbDir, sql.FileName)
+	backupPath := dbPath + backupSuffix
+	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		ds.logger.Warn("recovering database from backup after an interrupted restore")
+		return renameDBFile(backupPath, dbPath)
+	}
+	return removeDBFile(backupPath)
+}
+
 // Close closes the store.
 func (ds *DistributedStore) Close() error {
+	close(ds.shutdownCh)
+	ds.wg.Wait()
+
 	if err := ds.db.Close(); err != nil {
 		return err
 	}
@@ -143,9 +536,48 @@ func (ds *DistributedStore) Close() error {
 	return nil
 }
 
-func (ds *DistributedStore) Leader() string {
+func (ds *DistributedStore) Leader() (string, error) {
 	_, serverID := ds.raft.LeaderWithID()
-	return strings.Split(string(serverID), "|")[1]
+	if serverID == "" {
+		return "", ErrNoLeader
+	}
+	if meta, ok := ds.nodeMeta(string(serverID)); ok {
+		return meta.Addr(), nil
+	}
+	// Clusters created by earlier versions encode the address in the ID.
+	if addr, ok := LegacyHTTPAddr(string(serverID)); ok {
+		return addr, nil
+	}
+	return "", ErrNoLeader
+}
+
+// LegacyHTTPAddr returns the HTTP address in a server ID of the form
+// "id|httpAddr", which earlier versions used.
+func LegacyHTTPAddr(serverID string) (string, bool) {
+	_, addr, ok := strings.Cut(serverID, "|")
+	return addr, ok && addr != ""
+}
+
+func (ds *DistributedStore) WaitForLeader(timeout time.Duration) (string, error) {
+	leader, err := ds.Leader()
+	if err == nil || timeout <= 0 {
+		return leader, err
+	}
+
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if leader, err := ds.Leader(); err == nil {
+				return leader, nil
+			}
+		case <-timer.C:
+			return "", ErrNoLeader
+		}
+	}
 }
 
 func (ds *DistributedStore) Stats() (map[string]interface{}, error) {
@@ -153,57 +585,330 @@ func (ds *DistributedStore) Stats() (map[string]interface{}, error) {
 		"path": ds.dbDir,
 	}
 
-	stat, err := os.Stat(ds.dbDir)
-	if err != nil {
-		return nil, err
+	if stat, err := os.Stat(ds.dbDir); err != nil {
+		dbStatus["error"] = err.Error()
+	} else {
+		dbStatus["size"] = stat.Size()
 	}
-	dbStatus["size"] = stat.Size()
 
+	// An empty leader means there is none.
+	leader, _ := ds.Leader()
 	status := map[string]interface{}{
+		"node_id":  ds.serverID,
 		"raft":     ds.raft.Stats(),
-		"leader":   ds.Leader(),
+		"leader":   leader,
+		"nodes":    ds.nodeMetas(),
 		"dbStatus": dbStatus,
 	}
 	return status, nil
 }
 
+type commandType string
+
+const (
+	commandExecute    commandType = ""            // Execute SQL.
+	commandSetNode    commandType = "set_node"    // Set the metadata of a node.
+	commandRemoveNode commandType = "remove_node" // Delete the metadata of a node.
+)
+
+// Command is the payload of a Raft log entry. Params are carried with the SQL
+// so that every replica binds exactly the same values. An execute command
+// holds either a single statement in SQL or a transactional batch in
+// Statements.
 type Command struct {
-	SQL string `json:"sql"`
+	Type       commandType     `json:"type,omitempty"`
+	SQL        string          `json:"sql,omitempty"`
+	Params     *sql.Params     `json:"params,omitempty"`
+	Statements []sql.Statement `json:"statements,omitempty"`
+
+	NodeID string    `json:"node_id,omitempty"`
+	Node   *NodeMeta `json:"node,omitempty"`
 }
 
-func (ds *DistributedStore) Execute(query string) (*sql.ExecuteResult, error) {
+func (ds *DistributedStore) Execute(ctx context.Context, stmt sql.Statement) (*sql.ExecuteResult, uint64, error) {
+	defer observeSince(metrics.ExecuteDuration.WithLabelValues("execute"), time.Now())
+	r, idx, err := ds.apply(ctx, &Command{
+		SQL:    stmt.SQL,
+		Params: stmt.Params,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return r.result, idx, r.error
+}
+
+func (ds *DistributedStore) ExecuteBatch(ctx context.Context, stmts []sql.Statement) ([]*sql.ExecuteResult, uint64, error) {
+	defer observeSince(metrics.ExecuteDuration.WithLabelValues("batch"), time.Now())
+	r, idx, err := ds.apply(ctx, &Command{
+		Statements: stmts,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return r.results, idx, r.error
+}
+
+// apply replicates the command through Raft and returns the response of the
+// local FSM and the index of the log entry. It waits for the entry to be
+// committed until ctx is done, or for raftTimeout if ctx has no deadline.
+func (ds *DistributedStore) apply(ctx context.Context, c *Command) (*fsmExecuteResponse, uint64, error) {
 	if ds.raft.State() != raft.Leader {
-		return nil, ErrNotLeader
+		return nil, 0, ErrNotLeader
 	}
 
-	c := &Command{
-		SQL: query,
+	if c.Type == commandExecute {
+		// Reject bad params here rather than replicating a command that fails on every node.
+		for _, stmt := range c.statements() {
+			if _, err := stmt.Args(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		// Resolve now(), random() and friends once, here on the leader, so that
+		// every replica applies the same values.
+		ds.dbMu.RLock()
+		nondeterministic := ds.db.NonDeterministicFunctions()
+		ds.dbMu.RUnlock()
+		if err := c.makeDeterministic(time.Now(), nondeterministic); err != nil {
+			return nil, 0, err
+		}
 	}
+
 	b, err := json.Marshal(c)
 	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	f := ds.raft.Apply(b, ctxTimeout(ctx, raftTimeout))
+	if err := waitFuture(ctx, f); err != nil {
+		if errors.Is(err, ctx.Err()) {
+			// The entry may have been replicated already, and be applied.
+			return nil, 0, fmt.Errorf("%w: the write may still be applied", err)
+		}
+		return nil, 0, err
+	}
+	metrics.RaftApplyDuration.Observe(time.Since(start).Seconds())
+
+	return f.Response().(*fsmExecuteResponse), f.Index(), nil
+}
+
+// statements returns the statements carried by the command.
+func (c *Command) statements() []sql.Statement {
+	if len(c.Statements) > 0 {
+		return c.Statements
+	}
+	return []sql.Statement{{SQL: c.SQL, Params: c.Params}}
+}
+
+// makeDeterministic rewrites the command's statements with sql.MakeDeterministic.
+// All statements share the same transaction time.
+func (c *Command) makeDeterministic(now time.Time, nondeterministic map[string]bool) error {
+	if len(c.Statements) > 0 {
+		stmts := make([]sql.Statement, len(c.Statements))
+		for i, stmt := range c.Statements {
+			s, err := sql.MakeDeterministic(stmt, now, nondeterministic)
+			if err != nil {
+				return fmt.Errorf("statement %d: %w", i+1, err)
+			}
+			stmts[i] = s
+		}
+		c.Statements = stmts
+		return nil
+	}
+
+	stmt, err := sql.MakeDeterministic(sql.Statement{SQL: c.SQL, Params: c.Params}, now, nondeterministic)
+	if err != nil {
+		return err
+	}
+	c.SQL = stmt.SQL
+	return nil
+}
+
+func (ds *DistributedStore) Query(ctx context.Context, stmt sql.Statement, opts QueryOptions) (*sql.QueryResult, error) {
+	rows := &sql.QueryResult{}
+	if err := ds.QueryRows(ctx, stmt, opts, rows); err != nil {
 		return nil, err
 	}
+	return rows, nil
+}
+
+// QueryRows reads the database in another goroutine, at most readWindow rows
+// ahead of w, so that only the query and not the client holds the database.
+// A snapshot restore interrupts reads in progress, which then fail with
+// ErrRestoring.
+func (ds *DistributedStore) QueryRows(ctx context.Context, stmt sql.Statement, opts QueryOptions, w sql.RowWriter) error {
+	defer observeSince(metrics.QueryDuration.WithLabelValues(opts.Level.String()), time.Now())
+	args, err := stmt.Args()
+	if err != nil {
+		return err
+	}
+	if err := ds.checkRead(ctx, opts); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	ch := make(chan rowEvent, readWindow)
+	done := make(chan error, 1)
+	go func() {
+		done <- ds.readRows(ctx, cancel, &rowPipe{ctx: ctx, ch: ch}, stmt.SQL, args)
+		close(ch)
+	}()
+
+	// Once w fails, stop the read and drain what it already sent.
+	var werr error
+	for e := range ch {
+		if werr != nil {
+			continue
+		}
+		if e.header {
+			werr = w.WriteColumns(e.columns, e.types)
+		} else {
+			werr = w.WriteRow(e.values)
+		}
+		if werr != nil {
+			cancel(werr)
+		}
+	}
+	if werr != nil {
+		return werr
+	}
+	return <-done
+}
+
+// checkRead makes sure the node may serve a read at the consistency and
+// freshness opts ask for, waiting for it to catch up if needed.
+func (ds *DistributedStore) checkRead(ctx context.Context, opts QueryOptions) error {
+	if opts.Level >= Weak && ds.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if opts.Level == Strong {
+		if err := waitFuture(ctx, ds.raft.VerifyLeader()); err != nil {
+			if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+				return ErrNotLeader
+			}
+			return err
+		}
+		// Wait for every committed entry to be applied locally.
+		if err := waitFuture(ctx, ds.raft.Barrier(ctxTimeout(ctx, raftTimeout))); err != nil {
+			if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+				return ErrNotLeader
+			}
+			return err
+		}
+	}
+
+	if err := ds.checkStaleness(opts); err != nil {
+		return err
+	}
 
-	f := ds.raft.Apply(b, raftTimeout)
-	if e := f.(raft.Future); e.Error() != nil {
-		return nil, e.Error()
+	if opts.MinIndex > 0 {
+		return ds.waitForAppliedIndex(ctx, opts.MinIndex, opts.MinIndexTimeout)
 	}
+	return nil
+}
+
+func (ds *DistributedStore) Queries() []sql.RunningQuery {
+	return sql.Running()
+}
+
+func (ds *DistributedStore) KillQuery(id uint64) error {
+	return sql.Kill(id)
+}
+
+// checkStaleness returns ErrStaleRead if the node is further behind the
+// leader than opts allow. The leader itself is never stale.
+func (ds *DistributedStore) checkStaleness(opts QueryOptions) error {
+	if ds.raft.State() == raft.Leader {
+		return nil
+	}
+	if opts.MaxStaleness > 0 {
+		lastContact := ds.raft.LastContact()
+		if lastContact.IsZero() || time.Since(lastContact) > opts.MaxStaleness {
+			return ErrStaleRead
+		}
+	}
+	if opts.MaxLag > 0 {
+		// Raft's applied index counts every entry, like the commit index,
+		// including the barriers and configuration changes the database
+		// never sees.
+		commitIndex, appliedIndex := ds.raft.CommitIndex(), ds.raft.AppliedIndex()
+		if commitIndex > appliedIndex && commitIndex-appliedIndex > opts.MaxLag {
+			return ErrStaleRead
+		}
+	}
+	return nil
+}
 
-	r := f.Response().(*fsmExecuteResponse)
-	return r.result, r.error
+// AppliedIndex returns the index of the last log entry applied to the database.
+func (ds *DistributedStore) AppliedIndex() uint64 {
+	return ds.appliedIndex.Load()
 }
 
-func (ds *DistributedStore) Query(query string) (*sql.QueryResult, error) {
-	r, err := ds.db.Query(query)
-	return r, err
+// waitForAppliedIndex blocks until the FSM has applied idx, or returns
+// ErrIndexTimeout once timeout has passed and the error of ctx once it is
+// done.
+func (ds *DistributedStore) waitForAppliedIndex(ctx context.Context, idx uint64, timeout time.Duration) error {
+	if ds.appliedIndex.Load() >= idx {
+		return nil
+	}
+
+	ticker := time.NewTicker(appliedIndexPollInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ds.appliedIndex.Load() >= idx {
+				return nil
+			}
+		case <-timer.C:
+			return ErrIndexTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
-func (ds *DistributedStore) Join(nodeID string, addr string) error {
-	ds.logger.Printf("received join request for remote node %s at %s", nodeID, addr)
+// waitFuture waits for f to complete, or returns the error of ctx once it is
+// done. Raft keeps processing f either way.
+func waitFuture(ctx context.Context, f raft.Future) error {
+	done := make(chan error, 1)
+	go func() { done <- f.Error() }()
+	select {
+	case err := <-done:
+		if err == raft.ErrEnqueueTimeout && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ctxTimeout returns the time left until the deadline of ctx, or def if it
+// has none.
+func ctxTimeout(ctx context.Context, def time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return max(time.Until(deadline), time.Millisecond)
+	}
+	return def
+}
+
+func (ds *DistributedStore) Join(nodeID string, addr string, voter bool, meta NodeMeta) error {
+	ds.logger.Info("received join request", "node", nodeID, "addr", addr, "voter", voter)
+	if ds.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
 
 	configFuture := ds.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
-		ds.logger.Printf("failed to get raft configuration: %v", err)
+		ds.logger.Error("failed to get raft configuration", "error", err)
 		return err
 	}
 
@@ -212,10 +917,15 @@ func (ds *DistributedStore) Join(nodeID string, addr string) error {
 		// that node may need to be removed from the config first.
 		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(addr) {
 			// However if *both* the ID and the address are the same, then nothing -- not even
-			// a join operation -- is needed.
+			// a join operation -- is needed, unless the node changes its role.
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
-				ds.logger.Printf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
-				return nil
+				ds.logger.Info("node already member of cluster, updating its metadata", "node", nodeID, "addr", addr)
+				if (srv.Suffrage == raft.Voter) != voter {
+					if err := ds.SetVoter(nodeID, voter); err != nil {
+						return err
+					}
+				}
+				return ds.SetNodeMeta(nodeID, meta)
 			}
 
 			future := ds.raft.RemoveServer(srv.ID, 0, 0)
@@ -225,59 +935,238 @@ func (ds *DistributedStore) Join(nodeID string, addr string) error {
 		}
 	}
 
-	f := ds.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, time.Duration(time.Duration(30).Seconds()))
+	var f raft.IndexFuture
+	if voter {
+		f = ds.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, time.Duration(time.Duration(30).Seconds()))
+	} else {
+		f = ds.raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, time.Duration(time.Duration(30).Seconds()))
+	}
 	if f.Error() != nil {
 		return f.Error()
 	}
-	ds.logger.Printf("node %s at %s joined successfully", nodeID, addr)
-	return nil
+	ds.logger.Info("node joined", "node", nodeID, "addr", addr)
+	return ds.SetNodeMeta(nodeID, meta)
 }
 
 type fsmExecuteResponse struct {
-	result *sql.ExecuteResult
-	error  error
+	result  *sql.ExecuteResult
+	results []*sql.ExecuteResult
+	error   error
 }
 
-// Apply applies a Raft log entry to the database.
+// Apply applies a Raft log entry to the database. Entries the database
+// already contains, which Raft replays after a restart, are skipped.
 func (ds *DistributedStore) Apply(l *raft.Log) interface{} {
+	if l.Index <= ds.appliedIndex.Load() {
+		return &fsmExecuteResponse{}
+	}
+
 	var c Command
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
+	defer ds.appliedIndex.Store(l.Index)
+
+	switch c.Type {
+	case commandSetNode:
+		return &fsmExecuteResponse{error: ds.applySetNode(c.NodeID, c.Node, l.Index)}
+	case commandRemoveNode:
+		return &fsmExecuteResponse{error: ds.applySetNode(c.NodeID, nil, l.Index)}
+	}
 
-	r, err := ds.db.Execute(c.SQL)
-	return &fsmExecuteResponse{result: r, error: err}
+	// Every node must apply the entry the same way, so it is never cancelled.
+	r, err := ds.db.ExecuteBatch(context.Background(), c.statements(), l.Index)
+	if len(c.Statements) > 0 {
+		return &fsmExecuteResponse{results: r, error: err}
+	}
+	if err != nil {
+		return &fsmExecuteResponse{error: err}
+	}
+	return &fsmExecuteResponse{result: r[0]}
 }
 
 type fsmSnapshot struct {
-	snapshotDir string
+	snapshotDir  string
+	format       SnapshotFormat
+	appliedIndex uint64    // Index of the last log entry applied to the database.
+	start        time.Time // When the snapshot was started.
 }
 
 // raft ensure that Apply and snaphot are not call together
 func (ds *DistributedStore) Snapshot() (raft.FSMSnapshot, error) {
-	snapshotBaseDir := os.TempDir()
-	snapshotDir, err := os.MkdirTemp(snapshotBaseDir, "duckdb_snapshot_*")
+	start := time.Now()
+	// Stage next to the database, on a disk with room for a copy of it.
+	snapshotDir, err := os.MkdirTemp(filepath.Dir(ds.dbDir), snapshotDirPattern)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
 	}
-	_, err = ds.db.Query(fmt.Sprintf("EXPORT DATABASE '%s' (FORMAT PARQUET);", snapshotDir))
-	if err != nil {
-		return nil, fmt.Errorf("failed to export database: %v", err)
+
+	switch ds.SnapshotFormat {
+	case SnapshotParquet:
+		if err := ds.db.Export(snapshotDir); err != nil {
+			os.RemoveAll(snapshotDir)
+			return nil, fmt.Errorf("failed to export database: %v", err)
+		}
+	default:
+		// Apply is not called while the snapshot is taken, so after the
+		// checkpoint the file holds the complete state and does not change.
+		if err := ds.db.Checkpoint(); err != nil {
+			os.RemoveAll(snapshotDir)
+			return nil, fmt.Errorf("failed to checkpoint database: %v", err)
+		}
+		if err := copyFile(filepath.Join(ds.dbDir, sql.FileName), filepath.Join(snapshotDir, sql.FileName)); err != nil {
+			os.RemoveAll(snapshotDir)
+			return nil, fmt.Errorf("failed to copy database: %v", err)
+		}
 	}
 
-	return &fsmSnapshot{snapshotDir: snapshotDir}, nil
+	return &fsmSnapshot{
+		snapshotDir:  snapshotDir,
+		format:       ds.SnapshotFormat,
+		appliedIndex: ds.appliedIndex.Load(),
+		start:        start,
+	}, nil
 }
 
+// Restore replaces the database with the snapshot. The snapshot is first
+// built into a staging database next to the live one and verified; only then
+// is it swapped in, so a failed or interrupted restore leaves the current
+// database untouched.
 func (ds *DistributedStore) Restore(snapshot io.ReadCloser) error {
 	defer snapshot.Close()
-	var err error
-	tmpDir, err := os.MkdirTemp("", "duckdb_restore_*")
+	// Only the restore of the snapshot on startup may be skipped.
+	if ds.skipRestore.Swap(false) {
+		ds.logger.Info("database already contains the latest snapshot, skipping restore")
+		return nil
+	}
+
+	// Stage next to the database so the restored file can be renamed into place.
+	tmpDir, err := os.MkdirTemp(filepath.Dir(ds.dbDir), restoreDirPattern)
 	if err != nil {
 		return fmt.Errorf("failed to create temp directory: %v", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	tarReader := tar.NewReader(snapshot)
+	snapshotDir := filepath.Join(tmpDir, "snapshot")
+	if err := extractSnapshot(snapshot, snapshotDir); err != nil {
+		return fmt.Errorf("failed to extract snapshot: %v", err)
+	}
+
+	stagingDir := filepath.Join(tmpDir, "staging")
+	if err := stageDB(snapshotDir, stagingDir); err != nil {
+		return fmt.Errorf("failed to stage database: %v", err)
+	}
+
+	appliedIndex, err := verifyDB(stagingDir)
+	if err != nil {
+		return fmt.Errorf("failed to verify restored database: %v", err)
+	}
+
+	if err := ds.replaceDB(filepath.Join(stagingDir, sql.FileName)); err != nil {
+		return fmt.Errorf("failed to replace database: %v", err)
+	}
+	ds.appliedIndex.Store(appliedIndex)
+	if err := ds.loadNodes(); err != nil {
+		return err
+	}
+	ds.logger.Info("restored database from snapshot", "applied_index", appliedIndex)
+
+	return nil
+}
+
+// extractSnapshot extracts a snapshot written by Persist into dir, checking
+// every file against the manifest. Snapshots written before they were
+// compressed are plain tar archives without a manifest, and are extracted
+// without checks.
+func extractSnapshot(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	compressed, err := isCompressed(br)
+	if err != nil {
+		return err
+	}
+	if !compressed {
+		slog.Warn("snapshot is not compressed, extracting it without checksums")
+		return extractTar(tar.NewReader(br), dir, nil)
+	}
+
+	zr, err := zstd.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tarReader := tar.NewReader(zr)
+
+	manifest, err := readManifestEntry(tarReader)
+	if err != nil {
+		return err
+	}
+	return extractTar(tarReader, dir, manifest)
+}
+
+// readManifest reads the manifest at the start of a snapshot written by
+// Persist. Snapshots written before they were compressed have no manifest,
+// for which it returns nil.
+func readManifest(r io.Reader) (*snapshotManifest, error) {
+	br := bufio.NewReader(r)
+	compressed, err := isCompressed(br)
+	if err != nil || !compressed {
+		return nil, err
+	}
+
+	zr, err := zstd.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readManifestEntry(tar.NewReader(zr))
+}
+
+// isCompressed reports whether the snapshot read by br is zstd compressed.
+func isCompressed(br *bufio.Reader) (bool, error) {
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(magic, zstdMagic), nil
+}
+
+// readManifestEntry reads the manifest, which must be the next entry of the
+// archive.
+func readManifestEntry(tarReader *tar.Reader) (*snapshotManifest, error) {
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if header.Name != manifestFile {
+		return nil, fmt.Errorf("snapshot does not start with a manifest")
+	}
+	var manifest snapshotManifest
+	if err := json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// extractTar extracts the rest of the tar archive into dir, rejecting entries
+// that would be written outside of dir. With a manifest, every file must be
+// listed in it with a matching size and checksum, and every listed file must
+// be present.
+func extractTar(tarReader *tar.Reader, dir string, manifest *snapshotManifest) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var expected map[string]snapshotFile
+	if manifest != nil {
+		expected = make(map[string]snapshotFile, len(manifest.Files))
+		for _, mf := range manifest.Files {
+			expected[mf.Name] = mf
+		}
+	}
+
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -287,8 +1176,10 @@ func (ds *DistributedStore) Restore(snapshot io.ReadCloser) error {
 			return err
 		}
 
-		// Construct the full path for the file/directory
-		targetPath := filepath.Join(tmpDir, header.Name)
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("invalid path %q in tar archive", header.Name)
+		}
+		targetPath := filepath.Join(dir, header.Name)
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -296,73 +1187,310 @@ func (ds *DistributedStore) Restore(snapshot io.ReadCloser) error {
 				return err
 			}
 		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+				return err
+			}
 			outFile, err := os.Create(targetPath)
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(outFile, tarReader)
+			h := sha256.New()
+			size, err := io.Copy(io.MultiWriter(outFile, h), tarReader)
 			outFile.Close()
 			if err != nil {
 				return err
 			}
+
+			if expected != nil {
+				mf, ok := expected[header.Name]
+				if !ok {
+					return fmt.Errorf("file %q is not in the manifest", header.Name)
+				}
+				if size != mf.Size || hex.EncodeToString(h.Sum(nil)) != mf.SHA256 {
+					return fmt.Errorf("checksum mismatch for file %q", header.Name)
+				}
+				delete(expected, header.Name)
+			}
 		default:
 			return fmt.Errorf("unknown type: %v in tar archive", header.Typeflag)
 		}
 	}
 
-	// Use DuckDB's IMPORT DATABASE command to restore the database from the directory
-	_, err = ds.db.Query(fmt.Sprintf("IMPORT DATABASE '%s';", tmpDir))
+	for name := range expected {
+		return fmt.Errorf("file %q of the manifest is missing", name)
+	}
+	return nil
+}
+
+// stageDB builds a database in stagingDir from an extracted snapshot. File
+// snapshots contain the database file, Parquet snapshots an export which is
+// imported into a new, empty database.
+func stageDB(snapshotDir, stagingDir string) error {
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return err
+	}
+
+	snapshotFile := filepath.Join(snapshotDir, sql.FileName)
+	if _, err := os.Stat(snapshotFile); err == nil {
+		return os.Rename(snapshotFile, filepath.Join(stagingDir, sql.FileName))
+	}
+
+	db, err := sql.Open(stagingDir)
 	if err != nil {
-		return fmt.Errorf("failed to import database: %v", err)
+		return err
+	}
+	if err := db.Import(snapshotDir); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// verifyDB checks that the database in dir can be opened and read, and
+// returns its applied index.
+func verifyDB(dir string) (uint64, error) {
+	db, err := sql.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	if err := db.Verify(); err != nil {
+		return 0, err
+	}
+	return db.AppliedIndex()
+}
+
+// replaceDB atomically swaps the database file at path in for the live one.
+// Reads holding the database are interrupted first.
+// The live file is kept as a backup until the new one has been opened, and
+// put back if that fails. A backup left behind by a crash is recovered or
+// removed by openDB.
+func (ds *DistributedStore) replaceDB(path string) error {
+	ds.interruptReads()
+	ds.dbMu.Lock()
+	ds.resumeReads()
+	defer ds.dbMu.Unlock()
+
+	if err := ds.db.Close(); err != nil {
+		return err
 	}
 
+	dbPath := filepath.Join(ds.dbDir, sql.FileName)
+	backupPath := dbPath + backupSuffix
+	if err := renameDBFile(dbPath, backupPath); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dbPath); err != nil {
+		return ds.reopenBackup(dbPath, backupPath, err)
+	}
+
+	db, err := sql.Open(ds.dbDir)
+	if err != nil {
+		os.Remove(dbPath)
+		return ds.reopenBackup(dbPath, backupPath, err)
+	}
+	ds.db = db
+
+	if err := removeDBFile(backupPath); err != nil {
+		ds.logger.Warn("failed to remove database backup", "error", err)
+	}
 	return nil
 }
 
+// reopenBackup moves the backup back in place after a failed swap and opens
+// it again. It returns the error that caused the swap to fail.
+func (ds *DistributedStore) reopenBackup(dbPath, backupPath string, cause error) error {
+	if err := renameDBFile(backupPath, dbPath); err != nil {
+		return fmt.Errorf("%v, and failed to restore backup: %v", cause, err)
+	}
+	db, err := sql.Open(ds.dbDir)
+	if err != nil {
+		return fmt.Errorf("%v, and failed to reopen backup: %v", cause, err)
+	}
+	ds.db = db
+	return cause
+}
+
+// renameDBFile renames a database file together with its write-ahead log.
+func renameDBFile(from, to string) error {
+	if err := os.Rename(from+walSuffix, to+walSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// removeDBFile removes a database file together with its write-ahead log.
+func removeDBFile(path string) error {
+	if err := os.Remove(path + walSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Persist writes the snapshot as a zstd compressed tar archive. The first
+// entry of the archive is a manifest with the checksum of every file, which
+// Restore validates before it touches the database.
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	tarWriter := tar.NewWriter(sink)
-	defer tarWriter.Close()
-	err := filepath.Walk(f.snapshotDir, func(file string, info os.FileInfo, err error) error {
-		if err != nil {
+	w := &countingWriter{w: sink}
+	if err := f.persist(w); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to archive snapshot directory: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	metrics.SnapshotDuration.Observe(time.Since(f.start).Seconds())
+	metrics.SnapshotSize.Set(float64(w.n))
+	return nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (f *fsmSnapshot) persist(w io.Writer) error {
+	manifest, err := newManifest(f.snapshotDir, f.format)
+	if err != nil {
+		return err
+	}
+	manifest.AppliedIndex = f.appliedIndex
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+	tarWriter := tar.NewWriter(zw)
+
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:     manifestFile,
+		Mode:     0644,
+		Size:     int64(len(b)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(b); err != nil {
+		return err
+	}
+
+	for _, mf := range manifest.Files {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name:     mf.Name,
+			Mode:     0644,
+			Size:     mf.Size,
+			Typeflag: tar.TypeReg,
+		}); err != nil {
 			return err
 		}
-
-		relPath, err := filepath.Rel(f.snapshotDir, file)
-		if err != nil {
+		if err := copyFileTo(tarWriter, filepath.Join(f.snapshotDir, filepath.FromSlash(mf.Name))); err != nil {
 			return err
 		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
 
-		header, err := tar.FileInfoHeader(info, relPath)
+// snapshotManifest describes the files of a snapshot.
+type snapshotManifest struct {
+	Version int            `json:"version"`
+	Format  SnapshotFormat `json:"format"`
+	// AppliedIndex is the index of the last log entry applied to the
+	// database. Missing from snapshots of earlier versions.
+	AppliedIndex uint64         `json:"applied_index,omitempty"`
+	Files        []snapshotFile `json:"files"`
+}
+
+type snapshotFile struct {
+	Name   string `json:"name"` // Slash separated path relative to the snapshot directory.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// newManifest builds the manifest of the files in dir.
+func newManifest(dir string, format SnapshotFormat) (*snapshotManifest, error) {
+	m := &snapshotManifest{
+		Version: manifestVersion,
+		Format:  format,
+	}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, file)
 		if err != nil {
 			return err
 		}
-		header.Name = relPath
 
-		if err := tarWriter.WriteHeader(header); err != nil {
+		f, err := os.Open(file)
+		if err != nil {
 			return err
 		}
-
-		if !info.IsDir() {
-			f, err := os.Open(file)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			_, err = io.Copy(tarWriter, f)
-			if err != nil {
-				return err
-			}
+		defer f.Close()
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		if err != nil {
+			return err
 		}
 
+		m.Files = append(m.Files, snapshotFile{
+			Name:   filepath.ToSlash(relPath),
+			Size:   size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
 		return nil
 	})
 	if err != nil {
-		sink.Cancel()
-		return fmt.Errorf("failed to archive snapshot directory: %v", err)
+		return nil, err
 	}
-
-	return sink.Close()
+	return m, nil
 }
 
 func (f *fsmSnapshot) Release() {
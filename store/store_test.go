@@ -0,0 +1,135 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// tarEntry is an entry of a test snapshot archive.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func regularFile(name, body string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeReg, body: body}
+}
+
+// manifestOf returns the manifest listing entries.
+func manifestOf(entries ...tarEntry) *snapshotManifest {
+	m := &snapshotManifest{Version: manifestVersion, Format: SnapshotFile}
+	for _, e := range entries {
+		sum := sha256.Sum256([]byte(e.body))
+		m.Files = append(m.Files, snapshotFile{Name: e.name, Size: int64(len(e.body)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	return m
+}
+
+// snapshotArchive builds a snapshot like Persist does: a zstd-compressed tar
+// archive starting with the manifest. Without a manifest it builds a plain
+// tar archive, like earlier versions did.
+func snapshotArchive(t *testing.T, manifest *snapshotManifest, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var zw *zstd.Encoder
+	if manifest != nil {
+		var err error
+		if zw, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+		tw = tar.NewWriter(zw)
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append([]tarEntry{regularFile(manifestFile, string(b))}, entries...)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestExtractSnapshot(t *testing.T) {
+	db := regularFile("duckdb.db", "database")
+	wal := regularFile("duckdb.db.wal", "log")
+	traversal := regularFile("../x", "outside")
+	absolute := regularFile("/tmp/duckdb_test_absolute", "outside")
+	symlink := tarEntry{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}
+	tampered := regularFile("duckdb.db", "databasf")
+	unknownVersion := manifestOf(db)
+	unknownVersion.Version = manifestVersion + 1
+
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		err     string // Empty if the archive is valid.
+	}{
+		{"valid", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(db, wal), db, wal) }, ""},
+		{"valid without manifest", func(t *testing.T) []byte { return snapshotArchive(t, nil, db) }, ""},
+		{"parent path", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(db, traversal), db, traversal) }, "invalid path"},
+		{"parent path without manifest", func(t *testing.T) []byte { return snapshotArchive(t, nil, traversal) }, "invalid path"},
+		{"absolute path", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(absolute), absolute) }, "invalid path"},
+		{"symlink", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(db, symlink), db, symlink) }, "unknown type"},
+		{"symlink without manifest", func(t *testing.T) []byte { return snapshotArchive(t, nil, symlink) }, "unknown type"},
+		{"tampered file", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(db), tampered) }, "checksum mismatch"},
+		{"file not in manifest", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(db), db, wal) }, "not in the manifest"},
+		{"file missing from archive", func(t *testing.T) []byte { return snapshotArchive(t, manifestOf(db, wal), db) }, "is missing"},
+		{"unknown manifest version", func(t *testing.T) []byte { return snapshotArchive(t, unknownVersion, db) }, "unsupported snapshot version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			dir := filepath.Join(base, "snapshot")
+			err := extractSnapshot(bytes.NewReader(tt.archive(t)), dir)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("extractSnapshot() error = %v", err)
+				}
+				b, err := os.ReadFile(filepath.Join(dir, db.name))
+				if err != nil || string(b) != db.body {
+					t.Errorf("extracted %s = %q, %v, want %q", db.name, b, err, db.body)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("extractSnapshot() error = %v, want %q", err, tt.err)
+			}
+			for _, path := range []string{filepath.Join(base, "x"), absolute.name} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Errorf("extractSnapshot() wrote %s outside of the snapshot directory", path)
+				}
+			}
+		})
+	}
+}